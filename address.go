@@ -9,11 +9,15 @@ var (
 	errAddressFormat = errors.New("error address format")
 )
 
-// Address 表示 "name" <uri> tag
+// Address 表示 "name" <uri>;tag=x;k=v ，RFC 3261 20.10 的 name-addr 和 addr-spec
 type Address struct {
-	Name           string
-	URI            URI
-	Tag            string
+	// 显示名称，去掉了引号和转义，可以是 utf8
+	Name string
+	URI  URI
+	// tag 参数，格式化时使用它的值
+	Tag string
+	// 参数，按照顺序，包括 tag
+	Params         []KV
 	OriginalString string `json:"-"`
 }
 
@@ -22,23 +26,53 @@ func (a *Address) Reset() {
 	a.Name = ""
 	a.URI.Reset()
 	a.Tag = ""
+	a.Params = nil
 	a.OriginalString = ""
 }
 
 // CopyTo copy 数据到 aa
 func (a *Address) CopyTo(aa *Address) {
 	aa.Name = a.Name
-	aa.URI = a.URI
+	a.URI.CopyTo(&aa.URI)
 	aa.Tag = a.Tag
+	aa.Params = append([]KV(nil), a.Params...)
 	aa.OriginalString = a.OriginalString
 }
 
+// Param 返回参数 key 的值，key 不区分大小写，第二个返回值表示是否存在
+func (a *Address) Param(key string) (string, bool) {
+	if strings.EqualFold(key, "tag") {
+		return a.Tag, a.Tag != ""
+	}
+	for i := 0; i < len(a.Params); i++ {
+		if strings.EqualFold(a.Params[i].Key, key) {
+			return a.Params[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// SetParam 设置参数，没有就添加到最后
+func (a *Address) SetParam(key, value string) {
+	if strings.EqualFold(key, "tag") {
+		a.Tag = value
+		return
+	}
+	for i := 0; i < len(a.Params); i++ {
+		if strings.EqualFold(a.Params[i].Key, key) {
+			a.Params[i].Value = value
+			return
+		}
+	}
+	a.Params = append(a.Params, KV{Key: key, Value: value})
+}
+
 // FormatTo 格式化到 writer 中。
 func (a *Address) FormatTo(writer Writer) error {
 	var err error
 	// name
 	if a.Name != "" {
-		_, err = writer.WriteString(a.Name)
+		_, err = writer.WriteString(quoteDisplayName(a.Name))
 		if err != nil {
 			return err
 		}
@@ -48,12 +82,50 @@ func (a *Address) FormatTo(writer Writer) error {
 		}
 	}
 	// uri
+	err = writer.WriteByte('<')
+	if err != nil {
+		return err
+	}
 	err = a.URI.FormatTo(writer)
 	if err != nil {
 		return err
 	}
+	err = writer.WriteByte('>')
+	if err != nil {
+		return err
+	}
+	// 参数，tag 使用 Tag 的值
+	hasTag := false
+	for i := 0; i < len(a.Params); i++ {
+		kv := a.Params[i]
+		if strings.EqualFold(kv.Key, "tag") {
+			if hasTag || a.Tag == "" {
+				continue
+			}
+			hasTag = true
+			kv.Value = a.Tag
+		}
+		err = writer.WriteByte(';')
+		if err != nil {
+			return err
+		}
+		_, err = writer.WriteString(kv.Key)
+		if err != nil {
+			return err
+		}
+		if kv.Value != "" {
+			err = writer.WriteByte('=')
+			if err != nil {
+				return err
+			}
+			_, err = writer.WriteString(kv.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	// tag
-	if a.Tag != "" {
+	if a.Tag != "" && !hasTag {
 		_, err = writer.WriteString(";tag=")
 		if err != nil {
 			return err
@@ -68,39 +140,124 @@ func (a *Address) FormatTo(writer Writer) error {
 
 // Parse 从 line 解析数据。
 func (a *Address) Parse(line string) error {
+	a.Reset()
 	a.OriginalString = line
-	// 分段
-	part := strings.Split(line, ";")
-	// name uri
-	fields := strings.Fields(part[0])
-	switch len(fields) {
-	case 1:
-		// 只有 uri
-		err := a.URI.Parse(TrimByte(fields[0], '<', '>'))
+	line = strings.TrimSpace(line)
+	var params string
+	if strings.HasPrefix(line, `"`) {
+		// "name" <uri>
+		name, n, ok := unquote(line)
+		if !ok {
+			return errAddressFormat
+		}
+		a.Name = name
+		line = strings.TrimSpace(line[n:])
+		if !strings.HasPrefix(line, "<") {
+			return errAddressFormat
+		}
+	}
+	// 没有引号的显示名称不会有 ; ，在第一个 ; 之后的 < 是 addr-spec 的参数值
+	i := strings.IndexByte(line, '<')
+	if j := strings.IndexByte(line, ';'); j >= 0 && j < i {
+		i = -1
+	}
+	if i >= 0 {
+		// name <uri>;params
+		j := strings.IndexByte(line[i:], '>')
+		if j < 0 {
+			return errAddressFormat
+		}
+		if a.Name == "" {
+			a.Name = strings.TrimSpace(line[:i])
+		}
+		err := a.URI.Parse(line[i+1 : i+j])
 		if err != nil {
 			return err
 		}
-	case 2:
-		// name uri
-		a.Name = fields[0]
-		err := a.URI.Parse(TrimByte(fields[1], '<', '>'))
+		params = line[i+j+1:]
+	} else {
+		// uri;params ，uri 里面不能有 ; ，RFC 3261 20.10
+		uri := line
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			uri, params = line[:i], line[i:]
+		}
+		// 有些设备会这样 name uri
+		if i := strings.LastIndexAny(uri, " \t"); i >= 0 {
+			a.Name = strings.TrimSpace(uri[:i])
+			uri = uri[i+1:]
+		}
+		err := a.URI.Parse(uri)
 		if err != nil {
 			return err
 		}
-	default:
+	}
+	// ;k=v
+	params = strings.TrimSpace(params)
+	if params == "" {
+		return nil
+	}
+	if params[0] != ';' {
 		return errAddressFormat
 	}
-	// tag
-	if len(part) > 1 {
+	for _, p := range splitQuoted(params[1:], ';') {
 		var kv KV
-		err := kv.Parse(part[1])
+		err := kv.Parse(p)
 		if err != nil {
 			return errAddressFormat
 		}
-		if kv.Key == "tag" {
+		kv.Key = strings.TrimSpace(kv.Key)
+		if strings.EqualFold(kv.Key, "tag") {
 			a.Tag = kv.Value
 		}
+		a.Params = append(a.Params, kv)
 	}
-	//
 	return nil
 }
+
+// unquote 解析 line 开头的 quoted-string ，返回去掉引号和转义的字符串，
+// 以及 quoted-string 的长度，RFC 3261 25.1
+func unquote(line string) (string, int, bool) {
+	var str strings.Builder
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+			if i == len(line) {
+				return "", 0, false
+			}
+			str.WriteByte(line[i])
+		case '"':
+			return str.String(), i + 1, true
+		default:
+			str.WriteByte(line[i])
+		}
+	}
+	return "", 0, false
+}
+
+// quoteDisplayName 返回格式化的显示名称，不全是 token 的使用引号
+func quoteDisplayName(name string) string {
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) {
+			var str strings.Builder
+			str.WriteByte('"')
+			for j := 0; j < len(name); j++ {
+				if name[j] == '"' || name[j] == '\\' {
+					str.WriteByte('\\')
+				}
+				str.WriteByte(name[j])
+			}
+			str.WriteByte('"')
+			return str.String()
+		}
+	}
+	return name
+}
+
+// isTokenChar 返回 c 是否 token 的字符，RFC 3261 25.1
+func isTokenChar(c byte) bool {
+	if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+		return true
+	}
+	return strings.IndexByte("-.!%*_+`'~", c) >= 0
+}
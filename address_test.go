@@ -1,6 +1,9 @@
 package sip
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func Test_Address(t *testing.T) {
 	var addr Address
@@ -30,7 +33,51 @@ func Test_Address(t *testing.T) {
 	}
 }
 
+func Test_Address_NameAddr(t *testing.T) {
+	var addr Address
+	err := addr.Parse(`"Alice \"A\" Smith" <sip:a@b;transport=tcp>;x=y;tag=1;lr`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.Name != `Alice "A" Smith` || addr.Tag != "1" || addr.URI.Transport() != "tcp" {
+		t.FailNow()
+	}
+	if len(addr.Params) != 3 || addr.Params[0].Key != "x" || addr.Params[2].Key != "lr" {
+		t.FailNow()
+	}
+	// 格式化，参数的顺序不变
+	addr.Tag = "2"
+	var b strings.Builder
+	addr.FormatTo(&b)
+	if b.String() != `"Alice \"A\" Smith" <sip:a@b;transport=tcp>;x=y;tag=2;lr` {
+		t.Fatal(b.String())
+	}
+	// utf8 和多个 token
+	addr.Reset()
+	err = addr.Parse(`张三 李四 <sip:34020000001320000001@3402000000>;+sip.instance="<urn:uuid:1;2>"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.Name != "张三 李四" || addr.URI.Name != "34020000001320000001" {
+		t.FailNow()
+	}
+	if v, _ := addr.Param("+sip.instance"); v != `"<urn:uuid:1;2>"` {
+		t.Fatal(v)
+	}
+}
+
 func Test_Address_Error(t *testing.T) {
 	// uri_test.go
 	// transmission/kv_test.go
+	var addr Address
+	for _, s := range []string{
+		`"Alice <sip:a@b>`,
+		`"Alice" sip:a@b`,
+		`Alice <sip:a@b`,
+		`<sip:a@b> tag=1`,
+	} {
+		if err := addr.Parse(s); err == nil {
+			t.Fatal(s)
+		}
+	}
 }
@@ -0,0 +1,455 @@
+package sip
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errAuthMissing   = errors.New("missing digest authorization")
+	errAuthFormat    = errors.New("error digest authorization format")
+	errAuthAlgorithm = errors.New("unsupported digest algorithm")
+	errAuthQOP       = errors.New("unsupported digest qop")
+	errAuthNonce     = errors.New("unknown digest nonce")
+	errAuthStale     = errors.New("stale digest nonce")
+	errAuthReplay    = errors.New("digest nonce count replay")
+	errAuthURI       = errors.New("digest uri mismatch")
+	errAuthResponse  = errors.New("digest response mismatch")
+)
+
+// 摘要算法，RFC 3261 22.4 ，RFC 8760
+const (
+	DigestMD5           = "MD5"
+	DigestMD5Sess       = "MD5-sess"
+	DigestSHA256        = "SHA-256"
+	DigestSHA256Sess    = "SHA-256-sess"
+	DigestSHA512256     = "SHA-512-256"
+	DigestSHA512256Sess = "SHA-512-256-sess"
+)
+
+// qop
+const (
+	QOPAuth    = "auth"
+	QOPAuthInt = "auth-int"
+)
+
+// DefaultNonceExpires 是 DigestAuth.NonceExpires 的默认值
+const DefaultNonceExpires = 5 * time.Minute
+
+const (
+	// nc 表的长度达到这个值才清理过期的 nonce
+	digestNonceSweepLen = 1024
+	// nonce 的 HMAC 的字节
+	digestNonceMACLen = 16
+)
+
+// CredentialStore 用于 DigestAuth 查询用户的密码
+type CredentialStore interface {
+	// Password 返回 realm 下 username 的密码，用户不存在返回错误
+	Password(username, realm string) (string, error)
+}
+
+// DigestAuth 是摘要认证的服务端，RFC 3261 22 ，RFC 2617 ，RFC 8760 。
+// nonce 是生成时间加上 HMAC ，可以自己验证，不需要保存，过期的返回 stale=true 的挑战。
+// 使用 qop 的请求，只保存 nonce 的 nc ，nc 必须递增，防止重放。
+// 不使用 qop 的（RFC 2069）没有 nc ，截获的 Authorization 在 nonce 过期之前可以重放，
+// 需要的话缩短 NonceExpires
+type DigestAuth struct {
+	// 域
+	Realm string
+	// 支持的算法，按照优先的顺序，每个算法发送一个挑战，为空使用 MD5
+	Algorithms []string
+	// 支持的 qop ，为空表示不使用 qop ，兼容 RFC 2069
+	QOP []string
+	// nonce 的有效时间，小于 1 使用 DefaultNonceExpires
+	NonceExpires time.Duration
+	// true 使用 407 和 Proxy-Authenticate 、Proxy-Authorization
+	Proxy bool
+	// 查询密码
+	Store CredentialStore
+	// nonce 的 HMAC 密钥，为空时随机生成，多个实例需要互相认可 nonce 时设置为相同的
+	Key []byte
+	// 保护下面的字段
+	lock sync.Mutex
+	// 随机生成的密钥
+	key []byte
+	// 使用 qop 的 nonce 的 nc 表
+	nonces map[string]*digestNonce
+	// nonces 的长度达到它时清理
+	sweepLen int
+}
+
+// digestNonce 表示一个使用 qop 的 nonce 的状态
+type digestNonce struct {
+	// 生成的时间
+	time time.Time
+	// 最后一个 nc
+	nc uint64
+}
+
+// DigestCredentials 表示 Authorization 的摘要参数
+type DigestCredentials struct {
+	Username  string
+	Realm     string
+	Nonce     string
+	URI       string
+	Response  string
+	Algorithm string
+	CNonce    string
+	Opaque    string
+	QOP       string
+	NC        string
+}
+
+// Parse 从 line 解析数据，line 是 Digest k=v, k="v"
+func (c *DigestCredentials) Parse(line string) error {
+	*c = DigestCredentials{}
+	line = strings.TrimSpace(line)
+	i := strings.IndexAny(line, " \t")
+	if i < 0 || !strings.EqualFold(line[:i], "Digest") {
+		return errAuthFormat
+	}
+	for _, p := range splitQuoted(line[i+1:], ',') {
+		var kv KV
+		err := kv.Parse(p)
+		if err != nil {
+			return errAuthFormat
+		}
+		if strings.HasPrefix(kv.Value, `"`) {
+			var ok bool
+			kv.Value, _, ok = unquote(kv.Value)
+			if !ok {
+				return errAuthFormat
+			}
+		}
+		switch strings.ToLower(kv.Key) {
+		case "username":
+			c.Username = kv.Value
+		case "realm":
+			c.Realm = kv.Value
+		case "nonce":
+			c.Nonce = kv.Value
+		case "uri":
+			c.URI = kv.Value
+		case "response":
+			c.Response = kv.Value
+		case "algorithm":
+			c.Algorithm = kv.Value
+		case "cnonce":
+			c.CNonce = kv.Value
+		case "opaque":
+			c.Opaque = kv.Value
+		case "qop":
+			c.QOP = kv.Value
+		case "nc":
+			c.NC = kv.Value
+		}
+	}
+	if c.Username == "" || c.Nonce == "" || c.URI == "" || c.Response == "" {
+		return errAuthFormat
+	}
+	return nil
+}
+
+// digestHash 返回算法的 hash ，第二个返回值表示是否 -sess
+func digestHash(algorithm string) (func() hash.Hash, bool, error) {
+	if algorithm == "" {
+		algorithm = DigestMD5
+	}
+	sess := false
+	if len(algorithm) > 5 && strings.EqualFold(algorithm[len(algorithm)-5:], "-sess") {
+		sess = true
+		algorithm = algorithm[:len(algorithm)-5]
+	}
+	switch strings.ToUpper(algorithm) {
+	case DigestMD5:
+		return md5.New, sess, nil
+	case DigestSHA256:
+		return sha256.New, sess, nil
+	case DigestSHA512256:
+		return sha512.New512_256, sess, nil
+	}
+	return nil, false, errAuthAlgorithm
+}
+
+// digestHex 返回 parts 使用 : 连接后的 hash 的 16 进制
+func digestHex(newHash func() hash.Hash, parts ...string) string {
+	h := newHash()
+	for i, p := range parts {
+		if i > 0 {
+			h.Write([]byte{':'})
+		}
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DigestResponse 计算摘要认证的 response ，RFC 2617 3.2.2.1 。
+// body 只在 qop 是 auth-int 时使用
+func DigestResponse(c *DigestCredentials, method, password string, body []byte) (string, error) {
+	newHash, sess, err := digestHash(c.Algorithm)
+	if err != nil {
+		return "", err
+	}
+	// A1
+	ha1 := digestHex(newHash, c.Username, c.Realm, password)
+	if sess {
+		ha1 = digestHex(newHash, ha1, c.Nonce, c.CNonce)
+	}
+	// A2
+	var ha2 string
+	switch c.QOP {
+	case "", QOPAuth:
+		ha2 = digestHex(newHash, method, c.URI)
+	case QOPAuthInt:
+		h := newHash()
+		h.Write(body)
+		ha2 = digestHex(newHash, method, c.URI, hex.EncodeToString(h.Sum(nil)))
+	default:
+		return "", errAuthQOP
+	}
+	// response
+	if c.QOP == "" {
+		return digestHex(newHash, ha1, c.Nonce, ha2), nil
+	}
+	return digestHex(newHash, ha1, c.Nonce, c.NC, c.CNonce, c.QOP, ha2), nil
+}
+
+// header 返回挑战和认证的头名称
+func (a *DigestAuth) header() (challenge, authorization string) {
+	if a.Proxy {
+		return "Proxy-Authenticate", "Proxy-Authorization"
+	}
+	return "WWW-Authenticate", "Authorization"
+}
+
+// expires 返回 nonce 的有效时间
+func (a *DigestAuth) expires() time.Duration {
+	if a.NonceExpires < 1 {
+		return DefaultNonceExpires
+	}
+	return a.NonceExpires
+}
+
+// hmacKey 返回 nonce 的 HMAC 密钥
+func (a *DigestAuth) hmacKey() []byte {
+	if len(a.Key) > 0 {
+		return a.Key
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.key == nil {
+		a.key = make([]byte, 32)
+		rand.Read(a.key)
+	}
+	return a.key
+}
+
+// nonceMAC 返回时间戳 ts 的 HMAC
+func (a *DigestAuth) nonceMAC(ts []byte) []byte {
+	h := hmac.New(sha256.New, a.hmacKey())
+	h.Write(ts)
+	return h.Sum(nil)[:digestNonceMACLen]
+}
+
+// newNonce 返回 now 生成的 nonce ，16 进制的纳秒时间戳加上它的 HMAC
+func (a *DigestAuth) newNonce(now time.Time) string {
+	var b [8 + digestNonceMACLen]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(now.UnixNano()))
+	copy(b[8:], a.nonceMAC(b[:8]))
+	return hex.EncodeToString(b[:])
+}
+
+// parseNonce 验证 nonce 的 HMAC ，返回生成的时间
+func (a *DigestAuth) parseNonce(nonce string) (time.Time, bool) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 8+digestNonceMACLen {
+		return time.Time{}, false
+	}
+	if !hmac.Equal(b[8:], a.nonceMAC(b[:8])) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b[:8]))), true
+}
+
+// checkNonce 检查 nonce 是否有效，使用 qop 的检查并且更新 nc
+func (a *DigestAuth) checkNonce(c *DigestCredentials) error {
+	t, ok := a.parseNonce(c.Nonce)
+	if !ok {
+		return errAuthNonce
+	}
+	now := time.Now()
+	expires := a.expires()
+	if now.Sub(t) > expires {
+		return errAuthStale
+	}
+	// 没有 qop 的没有 nc ，不能检查重放
+	if c.QOP == "" {
+		return nil
+	}
+	nc, err := strconv.ParseUint(c.NC, 16, 32)
+	if err != nil {
+		return errAuthFormat
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	n := a.nonces[c.Nonce]
+	if n == nil {
+		if a.nonces == nil {
+			a.nonces = make(map[string]*digestNonce)
+		}
+		// 清理过期的，它们已经不能通过时间的检查
+		if len(a.nonces) >= a.sweepLen {
+			for k, v := range a.nonces {
+				if now.Sub(v.time) > expires {
+					delete(a.nonces, k)
+				}
+			}
+			a.sweepLen = 2 * len(a.nonces)
+			if a.sweepLen < digestNonceSweepLen {
+				a.sweepLen = digestNonceSweepLen
+			}
+		}
+		n = &digestNonce{time: t}
+		a.nonces[c.Nonce] = n
+	}
+	if nc <= n.nc {
+		return errAuthReplay
+	}
+	n.nc = nc
+	return nil
+}
+
+// Verify 检查 msg 的 Authorization ，成功返回用户名。
+// 只检查 realm 是 Realm 的，过期的 nonce 返回 errAuthStale
+func (a *DigestAuth) Verify(msg *Message) (string, error) {
+	_, key := a.header()
+	err := errAuthMissing
+	for i := 0; i < len(msg.Header.Others); i++ {
+		if !strings.EqualFold(msg.Header.Others[i].Key, key) {
+			continue
+		}
+		var c DigestCredentials
+		if c.Parse(msg.Header.Others[i].Value) != nil || c.Realm != a.Realm {
+			continue
+		}
+		err = a.verify(msg, &c)
+		if err == nil {
+			return c.Username, nil
+		}
+	}
+	return "", err
+}
+
+// verify 检查 c
+func (a *DigestAuth) verify(msg *Message, c *DigestCredentials) error {
+	// 算法
+	if !a.hasAlgorithm(c.Algorithm) {
+		return errAuthAlgorithm
+	}
+	// qop
+	if c.QOP != "" || len(a.QOP) > 0 {
+		if !containsFold(a.QOP, c.QOP) {
+			return errAuthQOP
+		}
+		if c.CNonce == "" || c.NC == "" {
+			return errAuthFormat
+		}
+	}
+	// uri
+	if c.URI != msg.RequestURI() {
+		return errAuthURI
+	}
+	// response
+	password, err := a.Store.Password(c.Username, c.Realm)
+	if err != nil {
+		return err
+	}
+	response, err := DigestResponse(c, msg.StartLine[0], password, msg.Body.Bytes())
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(response), []byte(strings.ToLower(c.Response))) != 1 {
+		return errAuthResponse
+	}
+	// response 正确后再检查 nonce ，这样 stale 才有意义
+	return a.checkNonce(c)
+}
+
+// hasAlgorithm 返回是否支持 algorithm
+func (a *DigestAuth) hasAlgorithm(algorithm string) bool {
+	if algorithm == "" {
+		algorithm = DigestMD5
+	}
+	if len(a.Algorithms) < 1 {
+		return strings.EqualFold(algorithm, DigestMD5)
+	}
+	return containsFold(a.Algorithms, algorithm)
+}
+
+// containsFold 返回 ss 是否包含 s ，不区分大小写
+func containsFold(ss []string, s string) bool {
+	for _, v := range ss {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Challenge 添加挑战的头到响应 res ，每个算法一个，使用同一个 nonce
+func (a *DigestAuth) Challenge(res *Message, stale bool) {
+	key, _ := a.header()
+	algorithms := a.Algorithms
+	if len(algorithms) < 1 {
+		algorithms = []string{DigestMD5}
+	}
+	nonce := a.newNonce(time.Now())
+	for _, algorithm := range algorithms {
+		var str strings.Builder
+		str.WriteString(`Digest realm="`)
+		str.WriteString(a.Realm)
+		str.WriteString(`", nonce="`)
+		str.WriteString(nonce)
+		str.WriteString(`", algorithm=`)
+		str.WriteString(algorithm)
+		if len(a.QOP) > 0 {
+			str.WriteString(`, qop="`)
+			str.WriteString(strings.Join(a.QOP, ","))
+			str.WriteString(`"`)
+		}
+		if stale {
+			str.WriteString(", stale=TRUE")
+		}
+		res.Header.Others = append(res.Header.Others, KV{Key: key, Value: str.String()})
+	}
+}
+
+// Authenticate 检查请求 r 的认证，成功返回用户名。
+// 失败时发送 401 或者 407 的挑战，nonce 过期的带有 stale=true ，调用者不需要再响应
+func (a *DigestAuth) Authenticate(r *Request) (string, bool) {
+	username, err := a.Verify(r.Message)
+	if err == nil {
+		return username, true
+	}
+	status := StatusUnauthorized
+	if a.Proxy {
+		status = StatusProxyAuthenticationRequired
+	}
+	res := r.NewResponse(status, "")
+	a.Challenge(res, err == errAuthStale)
+	r.WriteResponse(res)
+	return "", false
+}
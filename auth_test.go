@@ -0,0 +1,136 @@
+package sip
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCredentialStore map[string]string
+
+func (s testCredentialStore) Password(username, realm string) (string, error) {
+	p, ok := s[username]
+	if !ok {
+		return "", errors.New("unknown user")
+	}
+	return p, nil
+}
+
+func Test_DigestResponse(t *testing.T) {
+	// RFC 2617 3.5
+	c := DigestCredentials{
+		Username: "Mufasa",
+		Realm:    "testrealm@host.com",
+		Nonce:    "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+		URI:      "/dir/index.html",
+		QOP:      "auth",
+		NC:       "00000001",
+		CNonce:   "0a4f113b",
+	}
+	r, err := DigestResponse(&c, "GET", "Circle Of Life", nil)
+	if err != nil || r != "6629fae49393a05397450978507c4ef1" {
+		t.Fatal(r)
+	}
+	// RFC 7616 3.9.1
+	c = DigestCredentials{
+		Username:  "Mufasa",
+		Realm:     "http-auth@example.org",
+		Nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		URI:       "/dir/index.html",
+		Algorithm: "SHA-256",
+		QOP:       "auth",
+		NC:        "00000001",
+		CNonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+	}
+	r, err = DigestResponse(&c, "GET", "Circle of Life", nil)
+	if err != nil || r != "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1" {
+		t.Fatal(r)
+	}
+	c.Algorithm = "SHA-1"
+	if _, err = DigestResponse(&c, "GET", "Circle of Life", nil); err == nil {
+		t.FailNow()
+	}
+}
+
+func Test_DigestAuth(t *testing.T) {
+	a := &DigestAuth{
+		Realm:      "3402000000",
+		Algorithms: []string{DigestSHA512256Sess, DigestMD5},
+		QOP:        []string{QOPAuth, QOPAuthInt},
+		Store:      testCredentialStore{"34020000001320000001": "12345678"},
+	}
+	// 挑战
+	var res Message
+	a.Challenge(&res, false)
+	challenge := res.Header.GetOther("WWW-Authenticate", 0)
+	if len(res.Header.Others) != 2 || !strings.Contains(challenge, `algorithm=SHA-512-256-sess`) ||
+		!strings.Contains(challenge, `qop="auth,auth-int"`) {
+		t.Fatal(challenge)
+	}
+	var c DigestCredentials
+	c.Nonce = challenge[strings.Index(challenge, `nonce="`)+7:]
+	c.Nonce = c.Nonce[:strings.IndexByte(c.Nonce, '"')]
+	// 请求
+	var req Message
+	req.isRequest = true
+	req.InitStartLineOfRequest(MethodRegister, "sip:3402000000@192.168.1.2:5060")
+	req.Body.WriteString("body")
+	c.Username = "34020000001320000001"
+	c.Realm = a.Realm
+	c.URI = req.RequestURI()
+	c.Algorithm = DigestSHA512256Sess
+	c.QOP = QOPAuthInt
+	c.CNonce = "0a4f113b"
+	authorize := func(nc string) {
+		c.NC = nc
+		c.Response, _ = DigestResponse(&c, MethodRegister, "12345678", req.Body.Bytes())
+		req.Header.Others = req.Header.Others[:0]
+		req.Header.Others = append(req.Header.Others, KV{Key: "Authorization", Value: `Digest username="` + c.Username +
+			`", realm="` + c.Realm + `", nonce="` + c.Nonce + `", uri="` + c.URI + `", response="` + c.Response +
+			`", algorithm=` + c.Algorithm + `, cnonce="` + c.CNonce + `", qop=` + c.QOP + `, nc=` + c.NC})
+	}
+	authorize("00000001")
+	username, err := a.Verify(&req)
+	if err != nil || username != c.Username {
+		t.Fatal(err)
+	}
+	// 重放
+	if _, err = a.Verify(&req); err != errAuthReplay {
+		t.Fatal(err)
+	}
+	authorize("00000002")
+	if _, err = a.Verify(&req); err != nil {
+		t.Fatal(err)
+	}
+	// 错误的 body
+	authorize("00000003")
+	req.Body.WriteString("x")
+	if _, err = a.Verify(&req); err != errAuthResponse {
+		t.Fatal(err)
+	}
+	// 过期
+	c.Nonce = a.newNonce(time.Now().Add(-a.expires() - time.Second))
+	authorize("00000001")
+	if _, err = a.Verify(&req); err != errAuthStale {
+		t.Fatal(err)
+	}
+	// 不是自己生成的 nonce
+	c.Nonce = (&DigestAuth{}).newNonce(time.Now())
+	authorize("00000001")
+	if _, err = a.Verify(&req); err != errAuthNonce {
+		t.Fatal(err)
+	}
+	// 相同的 Key 互相认可
+	a.Key = []byte("key")
+	c.Nonce = (&DigestAuth{Key: a.Key}).newNonce(time.Now())
+	authorize("00000001")
+	if _, err = a.Verify(&req); err != nil {
+		t.Fatal(err)
+	}
+	// 没有
+	req.Header.Others = req.Header.Others[:0]
+	if _, err = a.Verify(&req); err != errAuthMissing {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,154 @@
+package sip
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	errContactFormat = errors.New("error header Contact format")
+)
+
+// Contact 表示 Contact 头的一个值，RFC 3261 20.10 。
+// expires q +sip.instance reg-id 在 Params 里面，使用对应的方法读写，RFC 5626 4.1
+type Contact struct {
+	// * ，REGISTER 使用它移除所有的绑定，RFC 3261 10.2.2
+	Star bool
+	Address
+}
+
+// Reset 重置
+func (c *Contact) Reset() {
+	c.Star = false
+	c.Address.Reset()
+}
+
+// CopyTo 拷贝到 cc ，不共享参数
+func (c *Contact) CopyTo(cc *Contact) {
+	cc.Star = c.Star
+	c.Address.CopyTo(&cc.Address)
+}
+
+// Parse 从 line 解析数据，并检查 expires q reg-id 的格式
+func (c *Contact) Parse(line string) error {
+	c.Reset()
+	if strings.TrimSpace(line) == "*" {
+		c.Star = true
+		c.OriginalString = line
+		return nil
+	}
+	err := c.Address.Parse(line)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.Param("expires"); ok {
+		if _, ok = c.Expires(); !ok {
+			return errContactFormat
+		}
+	}
+	if _, ok := c.Param("q"); ok {
+		if _, ok = c.Q(); !ok {
+			return errContactFormat
+		}
+	}
+	if _, ok := c.Param("reg-id"); ok {
+		if _, ok = c.RegID(); !ok {
+			return errContactFormat
+		}
+	}
+	return nil
+}
+
+// FormatTo 格式化到 writer 中。
+func (c *Contact) FormatTo(writer Writer) error {
+	if c.Star {
+		return writer.WriteByte('*')
+	}
+	return c.Address.FormatTo(writer)
+}
+
+// Expires 返回 expires 参数，第二个返回值表示是否存在并且有效
+func (c *Contact) Expires() (uint32, bool) {
+	v, ok := c.Param("expires")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+// SetExpires 设置 expires 参数
+func (c *Contact) SetExpires(n uint32) {
+	c.SetParam("expires", strconv.FormatUint(uint64(n), 10))
+}
+
+// Q 返回 q 参数，范围是 0 到 1 ，最多 3 位小数，第二个返回值表示是否存在并且有效
+func (c *Contact) Q() (float64, bool) {
+	v, ok := c.Param("q")
+	if !ok {
+		return 0, false
+	}
+	// qvalue = ( "0" [ "." 0*3DIGIT ] ) / ( "1" [ "." 0*3("0") ] )
+	i := strings.IndexByte(v, '.')
+	if (i < 0 && len(v) != 1) || (i >= 0 && (i != 1 || len(v) > 5)) {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(v, 64)
+	if err != nil || q < 0 || q > 1 {
+		return 0, false
+	}
+	return q, true
+}
+
+// SetQ 设置 q 参数
+func (c *Contact) SetQ(q float64) {
+	c.SetParam("q", strconv.FormatFloat(q, 'f', -1, 64))
+}
+
+// Instance 返回 +sip.instance 参数，去掉了引号和 <> ，比如 urn:uuid:xxx
+func (c *Contact) Instance() string {
+	v, _ := c.Param("+sip.instance")
+	if strings.HasPrefix(v, `"`) {
+		v, _, _ = unquote(v)
+	}
+	return TrimByte(v, '<', '>')
+}
+
+// SetInstance 设置 +sip.instance 参数，instance 比如 urn:uuid:xxx
+func (c *Contact) SetInstance(instance string) {
+	c.SetParam("+sip.instance", `"<`+instance+`>"`)
+}
+
+// RegID 返回 reg-id 参数，第二个返回值表示是否存在并且有效
+func (c *Contact) RegID() (uint32, bool) {
+	v, ok := c.Param("reg-id")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+// SetRegID 设置 reg-id 参数
+func (c *Contact) SetRegID(n uint32) {
+	c.SetParam("reg-id", strconv.FormatUint(uint64(n), 10))
+}
+
+// ContactExpires 返回 c 的过期时间，RFC 3261 10.3 。
+// 优先使用 expires 参数，然后是 Expires 头，都没有返回 def
+func (h *Header) ContactExpires(c *Contact, def uint32) uint32 {
+	if n, ok := c.Expires(); ok {
+		return n
+	}
+	if h.Expires.OK() {
+		return h.Expires.Get()
+	}
+	return def
+}
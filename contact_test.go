@@ -0,0 +1,83 @@
+package sip
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_Contact(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n")
+	b.WriteString("To: Bob <sip:bob@biloxi.com>\r\n")
+	b.WriteString("From: Bob <sip:bob@biloxi.com>;tag=456248\r\n")
+	b.WriteString("Call-ID: 843817637684230@998sdasdh09\r\n")
+	b.WriteString("CSeq: 1826 REGISTER\r\n")
+	b.WriteString("Contact: \"Mr. Watson\" <sip:watson@worcester.bell-telephone.com>;q=0.7;expires=3600,\r\n")
+	b.WriteString(" <sip:watson@bell-telephone.com;transport=tcp>;q=0.1\r\n")
+	b.WriteString("m: <sip:line1@192.0.2.2;transport=tcp>;reg-id=1;+sip.instance=\"<urn:uuid:00000000-0000-1000-8000-000A95A0E128>\"\r\n")
+	b.WriteString("Expires: 7200\r\n")
+	b.WriteString("\r\n")
+	var h Header
+	_, err := h.ParseFrom(NewReader(&b, -1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Contact) != 3 {
+		t.FailNow()
+	}
+	c := &h.Contact[0]
+	if c.Name != "Mr. Watson" || c.URI.Name != "watson" || h.ContactExpires(c, 60) != 3600 {
+		t.FailNow()
+	}
+	if q, ok := c.Q(); !ok || q != 0.7 {
+		t.FailNow()
+	}
+	c = &h.Contact[1]
+	if _, ok := c.Expires(); ok || h.ContactExpires(c, 60) != 7200 || c.URI.Transport() != "tcp" {
+		t.FailNow()
+	}
+	c = &h.Contact[2]
+	if n, ok := c.RegID(); !ok || n != 1 || c.Instance() != "urn:uuid:00000000-0000-1000-8000-000A95A0E128" {
+		t.FailNow()
+	}
+	// 格式化
+	c = &h.Contact[1]
+	c.SetExpires(0)
+	var s strings.Builder
+	c.FormatTo(&s)
+	if s.String() != "<sip:watson@bell-telephone.com;transport=tcp>;q=0.1;expires=0" {
+		t.Fatal(s.String())
+	}
+	// addr-spec 的参数值有 <
+	err = c.Parse(`sip:alice@host;+sip.instance="<urn:uuid:1>"`)
+	if err != nil || c.Name != "" || c.URI.Name != "alice" || c.Instance() != "urn:uuid:1" {
+		t.Fatal(err)
+	}
+	// *
+	err = c.Parse(" * ")
+	if err != nil || !c.Star {
+		t.FailNow()
+	}
+	s.Reset()
+	c.FormatTo(&s)
+	if s.String() != "*" {
+		t.FailNow()
+	}
+}
+
+func Test_Contact_Error(t *testing.T) {
+	var c Contact
+	for _, s := range []string{
+		"<sip:a@b>;expires=abc",
+		"<sip:a@b>;q=1.5",
+		"<sip:a@b>;q=0.1234",
+		"<sip:a@b>;q=.5",
+		"<sip:a@b>;reg-id=0",
+		"<sip:a@b",
+	} {
+		if err := c.Parse(s); err == nil {
+			t.Fatal(s)
+		}
+	}
+}
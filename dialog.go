@@ -0,0 +1,224 @@
+package sip
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	errDialogMethod     = errors.New("dialog can only be created by INVITE or SUBSCRIBE")
+	errDialogStatus     = errors.New("dialog can only be created by 2xx response")
+	errDialogMissingTag = errors.New("dialog missing tag")
+)
+
+// Dialog 表示一个对话，RFC 3261 12 。
+// 使用 Server.AddDialog 添加到对话表后，收到的对话内的请求会匹配到它。
+type Dialog struct {
+	// Call-ID
+	CallID string
+	// 本方的 tag
+	LocalTag string
+	// 对方的 tag
+	RemoteTag string
+	// 本方的 URI
+	LocalURI URI
+	// 对方的 URI
+	RemoteURI URI
+	// 对方的 Contact ，对话内请求的 Request-URI
+	RemoteTarget URI
+	// 路由集合，按照对话内请求的 Route 的顺序
+	RouteSet []Address
+	// 本方的 CSeq ，发送请求时递增
+	LocalSeq uint32
+	// 对方的 CSeq ，0 表示还没有收到对方的请求
+	RemoteSeq uint32
+	// 保护 LocalSeq 、RemoteSeq 和 RemoteTarget
+	lock sync.Mutex
+}
+
+// checkDialogMessage 检查 req 和 res 是否可以创建对话
+func checkDialogMessage(req, res *Message) error {
+	if req.Header.CSeq.Method != MethodInvite && req.Header.CSeq.Method != MethodSubscribe {
+		return errDialogMethod
+	}
+	if res.statusClass() != '2' {
+		return errDialogStatus
+	}
+	if req.Header.From.Tag == "" || res.Header.To.Tag == "" {
+		return errDialogMissingTag
+	}
+	return nil
+}
+
+// NewDialogUAC 使用发送的请求 req 和收到的 2xx 响应 res 创建客户端的对话，RFC 3261 12.1.2
+func NewDialogUAC(req, res *Message) (*Dialog, error) {
+	err := checkDialogMessage(req, res)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dialog{
+		CallID:    req.Header.CallID,
+		LocalTag:  req.Header.From.Tag,
+		RemoteTag: res.Header.To.Tag,
+		LocalSeq:  req.Header.CSeq.SN,
+	}
+	req.Header.From.URI.CopyTo(&d.LocalURI)
+	req.Header.To.URI.CopyTo(&d.RemoteURI)
+	// 响应的 Contact ，有些设备没有带，使用请求的 Request-URI
+	if len(res.Header.Contact) > 0 && !res.Header.Contact[0].Star {
+		res.Header.Contact[0].URI.CopyTo(&d.RemoteTarget)
+	} else {
+		d.RemoteTarget.Parse(req.RequestURI())
+	}
+	// Record-Route 倒序
+	for i := len(res.Header.RecordRoute) - 1; i >= 0; i-- {
+		d.RouteSet = append(d.RouteSet, Address{})
+		res.Header.RecordRoute[i].CopyTo(&d.RouteSet[len(d.RouteSet)-1])
+	}
+	return d, nil
+}
+
+// NewDialogUAS 使用收到的请求 req 和发送的 2xx 响应 res 创建服务端的对话，RFC 3261 12.1.1
+func NewDialogUAS(req, res *Message) (*Dialog, error) {
+	err := checkDialogMessage(req, res)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dialog{
+		CallID:    req.Header.CallID,
+		LocalTag:  res.Header.To.Tag,
+		RemoteTag: req.Header.From.Tag,
+		RemoteSeq: req.Header.CSeq.SN,
+	}
+	req.Header.To.URI.CopyTo(&d.LocalURI)
+	req.Header.From.URI.CopyTo(&d.RemoteURI)
+	// 请求的 Contact ，有些设备没有带，使用 From
+	if len(req.Header.Contact) > 0 && !req.Header.Contact[0].Star {
+		req.Header.Contact[0].URI.CopyTo(&d.RemoteTarget)
+	} else {
+		req.Header.From.URI.CopyTo(&d.RemoteTarget)
+	}
+	// Record-Route 顺序
+	d.RouteSet = copyAddresses(d.RouteSet, req.Header.RecordRoute)
+	return d, nil
+}
+
+// key 返回对话表的 key
+func (d *Dialog) key() string {
+	return dialogKey(d.CallID, d.LocalTag, d.RemoteTag)
+}
+
+// newRequest 返回对话内的请求，填充了 start line 、From 、To 、Call-ID 、CSeq 、
+// Max-Forwards 和 Route ，没有 Via ，见 Server.NewDialogRequest 。
+// 除了 ACK 和 CANCEL ，LocalSeq 会递增，ACK 需要在收到 2xx 后马上创建。
+func (d *Dialog) newRequest(method string) *Message {
+	m := new(Message)
+	m.isRequest = true
+	m.InitStartLineOfRequest(method, "")
+	d.lock.Lock()
+	// CSeq
+	if method != MethodACK && method != MethodCancel {
+		d.LocalSeq++
+	}
+	m.Header.CSeq.SN = d.LocalSeq
+	// Request-URI 和 Route ，RFC 3261 12.2.1.1
+	m.SetRoute(d.RouteSet, &d.RemoteTarget)
+	d.lock.Unlock()
+	m.Header.CSeq.Method = method
+	// From To
+	d.LocalURI.CopyTo(&m.Header.From.URI)
+	m.Header.From.Tag = d.LocalTag
+	d.RemoteURI.CopyTo(&m.Header.To.URI)
+	m.Header.To.Tag = d.RemoteTag
+	m.Header.CallID = d.CallID
+	m.Header.MaxForwards.Set(70)
+	return m
+}
+
+// checkRemoteSeq 检查并更新对方的 CSeq ，
+// 如果比之前的小，返回 false ，RFC 3261 12.2.2
+func (d *Dialog) checkRemoteSeq(sn uint32) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.RemoteSeq != 0 && sn < d.RemoteSeq {
+		return false
+	}
+	d.RemoteSeq = sn
+	return true
+}
+
+// refreshTarget 处理目标刷新，msg 是收到的 re-INVITE 或 UPDATE 请求，或者它们的 2xx 响应，
+// 有 Contact 的，替换 RemoteTarget ，RFC 3261 12.2.1.2 12.2.2
+func (d *Dialog) refreshTarget(msg *Message) {
+	if msg.Header.CSeq.Method != MethodInvite && msg.Header.CSeq.Method != MethodUpdate {
+		return
+	}
+	if len(msg.Header.Contact) < 1 || msg.Header.Contact[0].Star {
+		return
+	}
+	d.lock.Lock()
+	msg.Header.Contact[0].URI.CopyTo(&d.RemoteTarget)
+	d.lock.Unlock()
+}
+
+// NewDialogRequest 返回对话 d 内的请求，Via 和 Contact 和 NewRequest 一样处理，
+// 其他的头由对话填充，见 Dialog 。ACK 需要在收到 2xx 后马上创建
+func (s *Server) NewDialogRequest(d *Dialog, method string, opts ...RequestOption) *Message {
+	m := d.newRequest(method)
+	s.initRequest(m, opts)
+	return m
+}
+
+// dialogKey 返回对话表的 key
+func dialogKey(callID, localTag, remoteTag string) string {
+	return callID + "\n" + localTag + "\n" + remoteTag
+}
+
+// dialogs 表示对话表
+type dialogs struct {
+	sync.RWMutex
+	d map[string]*Dialog
+}
+
+// init 初始化
+func (d *dialogs) init() {
+	d.d = make(map[string]*Dialog)
+}
+
+// AddDialog 添加 d 到对话表
+func (s *Server) AddDialog(d *Dialog) {
+	s.dialogs.Lock()
+	s.dialogs.d[d.key()] = d
+	s.dialogs.Unlock()
+}
+
+// RemoveDialog 从对话表移除 d
+func (s *Server) RemoveDialog(d *Dialog) {
+	key := d.key()
+	s.dialogs.Lock()
+	if s.dialogs.d[key] == d {
+		delete(s.dialogs.d, key)
+	}
+	s.dialogs.Unlock()
+}
+
+// MatchDialog 返回 msg 所属的对话，没有返回 nil 。
+// 收到的请求使用 To 的 tag 作为本方的 tag ，收到的响应使用 From 的 tag 。
+func (s *Server) MatchDialog(msg *Message) *Dialog {
+	var key string
+	if msg.isRequest {
+		if msg.Header.To.Tag == "" {
+			return nil
+		}
+		key = dialogKey(msg.Header.CallID, msg.Header.To.Tag, msg.Header.From.Tag)
+	} else {
+		if msg.Header.To.Tag == "" {
+			return nil
+		}
+		key = dialogKey(msg.Header.CallID, msg.Header.From.Tag, msg.Header.To.Tag)
+	}
+	s.dialogs.RLock()
+	d := s.dialogs.d[key]
+	s.dialogs.RUnlock()
+	return d
+}
@@ -0,0 +1,92 @@
+package sip
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func Test_Dialog(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("INVITE sip:bob@biloxi.com SIP/2.0\r\n")
+	b.WriteString("Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n")
+	b.WriteString("To: Bob <sip:bob@biloxi.com>\r\n")
+	b.WriteString("From: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n")
+	b.WriteString("Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n")
+	b.WriteString("CSeq: 314159 INVITE\r\n")
+	b.WriteString("Contact: <sip:alice@pc33.atlanta.com>\r\n")
+	b.WriteString("Content-Length: 0\r\n")
+	b.WriteString("\r\n")
+	var req Message
+	err := req.ParseFrom(NewReader(&b, -1), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	b.WriteString("SIP/2.0 200 OK\r\n")
+	b.WriteString("Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n")
+	b.WriteString("Record-Route: <sip:p1.example.com;lr>\r\n")
+	b.WriteString("Record-Route: <sip:p2.example.com;lr>\r\n")
+	b.WriteString("To: Bob <sip:bob@biloxi.com>;tag=a6c85cf\r\n")
+	b.WriteString("From: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n")
+	b.WriteString("Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n")
+	b.WriteString("CSeq: 314159 INVITE\r\n")
+	b.WriteString("Contact: <sip:bob@192.0.2.4>\r\n")
+	b.WriteString("Content-Length: 0\r\n")
+	b.WriteString("\r\n")
+	var res Message
+	err = res.ParseFrom(NewReader(&b, -1), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// uac
+	d, err := NewDialogUAC(&req, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.LocalTag != "1928301774" || d.RemoteTag != "a6c85cf" || d.LocalSeq != 314159 ||
+		len(d.RouteSet) != 2 || d.RouteSet[0].URI.Address != "p2.example.com" {
+		t.FailNow()
+	}
+	s := &Server{AddrPort: "192.0.2.1:5060"}
+	bye := s.NewDialogRequest(d, MethodBye)
+	if len(bye.Header.Via) != 1 || bye.Header.Via[0].Address != s.AddrPort ||
+		bye.Header.Via[0].Branch == "" || bye.Header.Via[0].RProt == nil {
+		t.FailNow()
+	}
+	if bye.RequestURI() != "sip:bob@192.0.2.4" ||
+		bye.Header.CSeq.SN != 314160 ||
+		bye.Header.To.Tag != "a6c85cf" ||
+		len(bye.Header.Route) != 2 || bye.Header.Route[0].URI.String() != "sip:p2.example.com;lr" {
+		t.FailNow()
+	}
+	// uas
+	d, err = NewDialogUAS(&req, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.LocalTag != "a6c85cf" || d.RemoteTag != "1928301774" || d.RemoteSeq != 314159 ||
+		d.RemoteTarget.Address != "pc33.atlanta.com" {
+		t.FailNow()
+	}
+	if d.checkRemoteSeq(314158) || !d.checkRemoteSeq(314160) {
+		t.FailNow()
+	}
+	// 目标刷新
+	req.Header.Contact[0].URI.Address = "pc34.atlanta.com"
+	req.Header.CSeq.Method = MethodBye
+	d.refreshTarget(&req)
+	if d.RemoteTarget.Address != "pc33.atlanta.com" {
+		t.FailNow()
+	}
+	req.Header.CSeq.Method = MethodUpdate
+	d.refreshTarget(&req)
+	if d.RemoteTarget.Address != "pc34.atlanta.com" {
+		t.FailNow()
+	}
+	// 没有 Via
+	_, err = s.newClientTransaction(context.Background(), nil, new(Message))
+	if err != errMissingHeaderVia {
+		t.FailNow()
+	}
+}
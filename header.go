@@ -3,6 +3,7 @@ package sip
 import (
 	"errors"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -19,6 +20,32 @@ var (
 	errMissingHeaderVia          = errors.New("missing header Via")
 )
 
+// compactHeaders 是头名称的简写，RFC 3261 7.3.3 ，RFC 3265 ，RFC 3515
+var compactHeaders = map[string]string{
+	"I": "Call-ID",
+	"V": "Via",
+	"F": "From",
+	"T": "To",
+	"M": "Contact",
+	"L": "Content-Length",
+	"C": "Content-Type",
+	"K": "Supported",
+	"S": "Subject",
+	"E": "Content-Encoding",
+	"O": "Event",
+	"U": "Allow-Events",
+	"R": "Refer-To",
+}
+
+// compactHeaderNames 是 compactHeaders 的反向，key 是大写的全称
+var compactHeaderNames = make(map[string]string)
+
+func init() {
+	for k, v := range compactHeaders {
+		compactHeaderNames[strings.ToUpper(v)] = strings.ToLower(k)
+	}
+}
+
 // HeaderIntValue 表示 Header 的整型值
 type HeaderIntValue[T int | uint | int32 | uint32 | int64 | uint64] struct {
 	n T
@@ -58,18 +85,25 @@ func (h *HeaderIntValue[T]) OK() bool {
 
 // Header 表示消息的一些必需的头字段
 type Header struct {
-	Via         []Via
+	Via []Via
+	// Route ，按照消息中的顺序
+	Route []Address
+	// Record-Route ，按照消息中的顺序
+	RecordRoute []Address
 	From        Address
 	To          Address
 	CallID      string
 	CSeq        CSeq
 	MaxForwards HeaderIntValue[uint32]
-	Contact     URI
+	// Contact ，按照消息中的顺序
+	Contact     []Contact
 	Expires     HeaderIntValue[uint32]
 	ContentType string
 	UserAgent   string
 	// 其他头
 	Others []KV
+	// 格式化时使用简写的头名称，减小 udp 消息的大小
+	Compact bool
 	// 自动
 	contentLength int64
 }
@@ -77,7 +111,12 @@ type Header struct {
 // CopyTo 将所有字段 copy 到 hh
 func (h *Header) CopyTo(hh *Header) {
 	hh.Via = hh.Via[:0]
-	hh.Via = append(hh.Via, h.Via...)
+	for i := 0; i < len(h.Via); i++ {
+		hh.Via = append(hh.Via, Via{})
+		h.Via[i].CopyTo(&hh.Via[i])
+	}
+	hh.Route = copyAddresses(hh.Route[:0], h.Route)
+	hh.RecordRoute = copyAddresses(hh.RecordRoute[:0], h.RecordRoute)
 	h.From.CopyTo(&hh.From)
 	h.To.CopyTo(&hh.To)
 	hh.CallID = h.CallID
@@ -85,31 +124,44 @@ func (h *Header) CopyTo(hh *Header) {
 	hh.CSeq.SN = h.CSeq.SN
 	hh.MaxForwards.n = h.MaxForwards.n
 	hh.MaxForwards.s = h.MaxForwards.s
-	hh.Contact = h.Contact
+	hh.Contact = hh.Contact[:0]
+	for i := 0; i < len(h.Contact); i++ {
+		hh.Contact = append(hh.Contact, Contact{})
+		h.Contact[i].CopyTo(&hh.Contact[i])
+	}
 	hh.ContentType = h.ContentType
 	hh.Others = hh.Others[:0]
 	hh.Others = append(hh.Others, h.Others...)
+	hh.Compact = h.Compact
 	hh.contentLength = h.contentLength
 }
 
 // Reset 重置所有字段
 func (h *Header) Reset() {
 	h.CallID = ""
+	h.CSeq.SN = 0
+	h.CSeq.Method = ""
+	h.CSeq.OriginalString = ""
+	h.Expires.n = 0
+	h.Expires.s = ""
 	h.To.Reset()
 	h.From.Reset()
-	h.Contact.Reset()
+	h.Contact = h.Contact[:0]
 	h.MaxForwards.n = 0
 	h.MaxForwards.s = ""
 	h.Via = h.Via[:0]
+	h.Route = h.Route[:0]
+	h.RecordRoute = h.RecordRoute[:0]
 	h.ContentType = ""
 	h.UserAgent = ""
 	h.Others = h.Others[:0]
+	h.Compact = false
 	h.contentLength = 0
 }
 
 // KeepBasic 重置 contact、contentType、useragent、other
 func (h *Header) KeepBasic() {
-	h.Contact.Reset()
+	h.Contact = h.Contact[:0]
 	h.ContentType = ""
 	h.UserAgent = ""
 	h.ResetOther()
@@ -171,9 +223,62 @@ func (h *Header) RemoveOther(key string) {
 	}
 }
 
-// ParseFrom 从 msg 解析出字段，注意解析的 other 的 key 是大写
+// copyAddresses 拷贝 src 到 dst 后面并返回，不共享参数
+func copyAddresses(dst, src []Address) []Address {
+	for i := 0; i < len(src); i++ {
+		dst = append(dst, Address{})
+		src[i].CopyTo(&dst[len(dst)-1])
+	}
+	return dst
+}
+
+// name 返回格式化时使用的头名称，Compact 为 true 且有简写的返回简写
+func (h *Header) name(key string) string {
+	if h.Compact {
+		if c, ok := compactHeaderNames[strings.ToUpper(key)]; ok {
+			return c
+		}
+	}
+	return key
+}
+
+// multiValueHeaders 是可以使用逗号分隔多个值的头，大写，RFC 3261 7.3.1 。
+// 不在这里的头，比如 WWW-Authenticate 和 Date ，值里面可能有逗号，不能分割
+var multiValueHeaders = map[string]bool{
+	"VIA":              true,
+	"CONTACT":          true,
+	"ROUTE":            true,
+	"RECORD-ROUTE":     true,
+	"ALLOW":            true,
+	"SUPPORTED":        true,
+	"REQUIRE":          true,
+	"PROXY-REQUIRE":    true,
+	"UNSUPPORTED":      true,
+	"ACCEPT":           true,
+	"ACCEPT-ENCODING":  true,
+	"ACCEPT-LANGUAGE":  true,
+	"ALLOW-EVENTS":     true,
+	"CONTENT-ENCODING": true,
+	"CONTENT-LANGUAGE": true,
+	"IN-REPLY-TO":      true,
+	"ALERT-INFO":       true,
+	"CALL-INFO":        true,
+	"ERROR-INFO":       true,
+	"WARNING":          true,
+	"PATH":             true,
+	"SERVICE-ROUTE":    true,
+}
+
+// ParseFrom 从 msg 解析出字段，简写的头名称会转换为全称，注意解析的 other 的 key 是大写。
+// 支持以空格或者 tab 开头的折行，可以有多个值的头，会按照逗号分割成多个。
+// max 小于 1 表示不限制大小
 func (h *Header) ParseFrom(reader Reader, max int) (int, error) {
 	h.Reset()
+	if max < 1 {
+		max = math.MaxInt
+	}
+	// 当前的头，可能有折行
+	var header string
 	for {
 		// 读取一行数据
 		line, err := reader.ReadLine()
@@ -191,63 +296,26 @@ func (h *Header) ParseFrom(reader Reader, max int) (int, error) {
 		if max < 0 {
 			return max, ErrLargeMessage
 		}
-		// 第一个':'
-		line = strings.TrimSpace(line)
-		i := strings.IndexByte(line, ':')
-		if i < 0 {
-			// 不支持多行 values 。
-			return max, errHeaderFormat
-		}
-		key := strings.TrimSpace(line[:i])
-		value := strings.TrimSpace(line[i+1:])
-		uKey := strings.ToUpper(key)
-		// 挑选出必要的头
-		switch uKey {
-		case "CALL-ID":
-			h.CallID = value
-		case "CSEQ":
-			err = h.CSeq.Parse(value)
-		case "TO":
-			err = h.To.Parse(value)
-		case "FROM":
-			err = h.From.Parse(value)
-		case "MAX-FORWARDS":
-			err = h.MaxForwards.Parse(value)
-			if err != nil {
-				err = errHeaderMaxForwardsFormat
-			}
-		case "VIA":
-			var via Via
-			err = via.Parse(value)
-			if err == nil {
-				h.Via = append(h.Via, via)
+		// 折行，RFC 3261 7.3.1
+		if line[0] == ' ' || line[0] == '\t' {
+			if header == "" {
+				return max, errHeaderFormat
 			}
-		case "EXPIRES":
-			err = h.Expires.Parse(value)
+			header += " " + strings.TrimSpace(line)
+			continue
+		}
+		// 上一个头
+		if header != "" {
+			err = h.parseLine(header)
 			if err != nil {
-				err = errHeaderExpiresFormat
-			}
-		case "CONTENT-TYPE":
-			h.ContentType = value
-		case "CONTACT":
-			value = TrimByte(value, '<', '>')
-			// 有这种格式的
-			if value == "*" {
-				h.Contact.Address = value
-				h.Contact.OriginalString = value
-			} else {
-				err = h.Contact.Parse(value)
+				return max, err
 			}
-		case "CONTENT-LENGTH":
-			n, _err := strconv.ParseInt(value, 10, 64)
-			if _err != nil || n < 0 {
-				err = errHeaderContentLengthFormat
-			} else {
-				h.contentLength = n
-			}
-		default:
-			h.Others = append(h.Others, KV{Key: key, Value: value})
 		}
+		header = line
+	}
+	// 最后一个头
+	if header != "" {
+		err := h.parseLine(header)
 		if err != nil {
 			return max, err
 		}
@@ -275,12 +343,153 @@ func (h *Header) ParseFrom(reader Reader, max int) (int, error) {
 	return max, nil
 }
 
+// parseLine 解析一个完整的头
+func (h *Header) parseLine(line string) error {
+	// 第一个':'
+	line = strings.TrimSpace(line)
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return errHeaderFormat
+	}
+	key := strings.TrimSpace(line[:i])
+	value := strings.TrimSpace(line[i+1:])
+	uKey := strings.ToUpper(key)
+	// 简写
+	if k, ok := compactHeaders[uKey]; ok {
+		key = k
+		uKey = strings.ToUpper(k)
+	}
+	// 单个值
+	if !multiValueHeaders[uKey] {
+		return h.parseValue(key, uKey, value)
+	}
+	// 多个值
+	for _, v := range splitHeaderValues(value) {
+		err := h.parseValue(key, uKey, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseValue 解析头的一个值
+func (h *Header) parseValue(key, uKey, value string) (err error) {
+	// 挑选出必要的头
+	switch uKey {
+	case "CALL-ID":
+		h.CallID = value
+	case "CSEQ":
+		err = h.CSeq.Parse(value)
+	case "TO":
+		err = h.To.Parse(value)
+	case "FROM":
+		err = h.From.Parse(value)
+	case "MAX-FORWARDS":
+		err = h.MaxForwards.Parse(value)
+		if err != nil {
+			err = errHeaderMaxForwardsFormat
+		}
+	case "VIA":
+		var via Via
+		err = via.Parse(value)
+		if err == nil {
+			h.Via = append(h.Via, via)
+		}
+	case "ROUTE":
+		err = parseAddressTo(&h.Route, value)
+	case "RECORD-ROUTE":
+		err = parseAddressTo(&h.RecordRoute, value)
+	case "EXPIRES":
+		err = h.Expires.Parse(value)
+		if err != nil {
+			err = errHeaderExpiresFormat
+		}
+	case "CONTENT-TYPE":
+		h.ContentType = value
+	case "CONTACT":
+		var c Contact
+		err = c.Parse(value)
+		if err == nil {
+			h.Contact = append(h.Contact, c)
+		}
+	case "CONTENT-LENGTH":
+		n, _err := strconv.ParseInt(value, 10, 64)
+		if _err != nil || n < 0 {
+			err = errHeaderContentLengthFormat
+		} else {
+			h.contentLength = n
+		}
+	default:
+		h.Others = append(h.Others, KV{Key: key, Value: value})
+	}
+	return
+}
+
+// parseAddressTo 解析 value 并添加到 addrs
+func parseAddressTo(addrs *[]Address, value string) error {
+	var a Address
+	err := a.Parse(value)
+	if err != nil {
+		return err
+	}
+	*addrs = append(*addrs, a)
+	return nil
+}
+
+// splitHeaderValues 使用逗号分割头的多个值，
+// 引号和尖括号里面的逗号不分割，RFC 3261 7.3.1
+func splitHeaderValues(value string) []string {
+	return splitQuoted(value, ',')
+}
+
+// splitQuoted 使用 sep 分割 value ，引号和尖括号里面的不分割，去掉空的部分
+func splitQuoted(value string, sep byte) []string {
+	var values []string
+	quoted, angle := false, false
+	begin := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			// 引号里面的转义
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case '<':
+			if !quoted {
+				angle = true
+			}
+		case '>':
+			if !quoted {
+				angle = false
+			}
+		case sep:
+			if !quoted && !angle {
+				if v := strings.TrimSpace(value[begin:i]); v != "" {
+					values = append(values, v)
+				}
+				begin = i + 1
+			}
+		}
+	}
+	if v := strings.TrimSpace(value[begin:]); v != "" {
+		values = append(values, v)
+	}
+	return values
+}
+
 // FormatTo 将数据写入到 writer ，不包含 ContentLength
 func (h *Header) FormatTo(writer Writer) error {
 	var err error
 	// Via
 	for i := 0; i < len(h.Via); i++ {
-		_, err = writer.WriteString("Via: ")
+		_, err = writer.WriteString(h.name("Via"))
+		if err != nil {
+			return err
+		}
+		_, err = writer.WriteString(": ")
 		if err != nil {
 			return err
 		}
@@ -293,18 +502,32 @@ func (h *Header) FormatTo(writer Writer) error {
 			return err
 		}
 	}
+	// Route
+	for i := 0; i < len(h.Route); i++ {
+		err = formatHeaderTo2(writer, "Route", &h.Route[i])
+		if err != nil {
+			return err
+		}
+	}
+	// Record-Route
+	for i := 0; i < len(h.RecordRoute); i++ {
+		err = formatHeaderTo2(writer, "Record-Route", &h.RecordRoute[i])
+		if err != nil {
+			return err
+		}
+	}
 	// From
-	err = formatHeaderTo2(writer, "From", &h.From)
+	err = formatHeaderTo2(writer, h.name("From"), &h.From)
 	if err != nil {
 		return err
 	}
 	// To
-	err = formatHeaderTo2(writer, "To", &h.To)
+	err = formatHeaderTo2(writer, h.name("To"), &h.To)
 	if err != nil {
 		return err
 	}
 	// Call-ID
-	err = formatHeaderTo(writer, "Call-ID", h.CallID)
+	err = formatHeaderTo(writer, h.name("Call-ID"), h.CallID)
 	if err != nil {
 		return err
 	}
@@ -314,8 +537,8 @@ func (h *Header) FormatTo(writer Writer) error {
 		return err
 	}
 	// Contact
-	if h.Contact.Scheme != "" && h.Contact.Name != "" && h.Contact.Address != "" {
-		err = formatHeaderTo2(writer, "Contact", &h.Contact)
+	for i := 0; i < len(h.Contact); i++ {
+		err = formatHeaderTo2(writer, h.name("Contact"), &h.Contact[i])
 		if err != nil {
 			return err
 		}
@@ -336,14 +559,14 @@ func (h *Header) FormatTo(writer Writer) error {
 	}
 	// Content-Type
 	if h.ContentType != "" {
-		err = formatHeaderTo(writer, "Content-Type", h.ContentType)
+		err = formatHeaderTo(writer, h.name("Content-Type"), h.ContentType)
 		if err != nil {
 			return err
 		}
 	}
 	// Others
 	for i := 0; i < len(h.Others); i++ {
-		err = formatHeaderTo(writer, h.Others[i].Key, h.Others[i].Value)
+		err = formatHeaderTo(writer, h.name(h.Others[i].Key), h.Others[i].Value)
 		if err != nil {
 			return err
 		}
@@ -357,7 +580,7 @@ func (h *Header) FormatTo(writer Writer) error {
 		return err
 	}
 	// Content-Length
-	err = formatHeaderTo(writer, "Content-Length", strconv.FormatInt(h.contentLength, 10))
+	err = formatHeaderTo(writer, h.name("Content-Length"), strconv.FormatInt(h.contentLength, 10))
 	if err != nil {
 		return err
 	}
@@ -29,3 +29,71 @@ func Test_Header(t *testing.T) {
 	h.FormatTo(&b2)
 	// os.Stderr.Write(b2.Bytes())
 }
+
+func Test_Header_Compact(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("v: SIP/2.0/UDP pc1.atlanta.com;branch=z9hG4bK776asdhds\r\n")
+	b.WriteString("t: Bob <sip:bob@biloxi.com>\r\n")
+	b.WriteString("f: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n")
+	b.WriteString("i: a84b4c76e66710@pc33.atlanta.com\r\n")
+	b.WriteString("CSeq: 314159 INVITE\r\n")
+	b.WriteString("m: <sip:alice@pc33.atlanta.com>\r\n")
+	b.WriteString("c: application/sdp\r\n")
+	b.WriteString("k: 100rel\r\n")
+	b.WriteString("o: presence\r\n")
+	b.WriteString("l: 0\r\n")
+	b.WriteString("\r\n")
+	var h Header
+	_, err := h.ParseFrom(NewReader(&b, -1), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Via) != 1 || h.To.Tag != "" || h.From.Tag != "1928301774" ||
+		h.CallID != "a84b4c76e66710@pc33.atlanta.com" || h.Contact[0].URI.Address != "pc33.atlanta.com" ||
+		h.ContentType != "application/sdp" {
+		t.FailNow()
+	}
+	if h.GetOther("Supported", 0) != "100rel" || h.GetOther("Event", 0) != "presence" {
+		t.FailNow()
+	}
+	// 格式化
+	h.Compact = true
+	b.Reset()
+	h.FormatTo(&b)
+	for _, s := range []string{"v: ", "f: ", "t: ", "i: ", "m: ", "c: ", "k: ", "o: ", "l: ", "CSeq: "} {
+		if !bytes.Contains(b.Bytes(), []byte("\r\n"+s)) && !bytes.HasPrefix(b.Bytes(), []byte(s)) {
+			t.Fatal(s)
+		}
+	}
+}
+
+func Test_Header_MultiValue(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("Via: SIP/2.0/UDP pc1.atlanta.com;branch=z9hG4bK776asdhds,\r\n")
+	b.WriteString("\tSIP/2.0/UDP pc2.atlanta.com;branch=z9hG4bK776asdhdt\r\n")
+	b.WriteString("To: Bob\r\n")
+	b.WriteString("  <sip:bob@biloxi.com>\r\n")
+	b.WriteString("From: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n")
+	b.WriteString("Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n")
+	b.WriteString("CSeq: 314159 INVITE\r\n")
+	b.WriteString("Record-Route: <sip:p1.example.com;lr>, \"a,b\" <sip:p2.example.com;lr>,<sip:p3.example.com?a=1,2>\r\n")
+	b.WriteString("Allow: INVITE, ACK,BYE\r\n")
+	b.WriteString("WWW-Authenticate: Digest realm=\"atlanta.com\", nonce=\"84a4cc6f3082121f32b42a2187831a9e\"\r\n")
+	b.WriteString("\r\n")
+	var h Header
+	_, err := h.ParseFrom(NewReader(&b, -1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Via) != 2 || h.Via[1].Address != "pc2.atlanta.com" || h.To.URI.Name != "bob" {
+		t.FailNow()
+	}
+	routes := h.RecordRoute
+	if len(routes) != 3 || routes[1].Name != "a,b" || routes[1].URI.Address != "p2.example.com" ||
+		len(routes[2].URI.Headers) != 1 || routes[2].URI.Headers[0].Value != "1,2" {
+		t.Fatal(routes)
+	}
+	if h.GetOther("Allow", 2) != "BYE" || h.GetOther("WWW-Authenticate", 1) != "" {
+		t.FailNow()
+	}
+}
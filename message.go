@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"math"
+	"strconv"
 	"strings"
 )
 
@@ -33,6 +35,8 @@ type Message struct {
 	Body bytes.Buffer
 	// 是否请求消息
 	isRequest bool
+	// SetRoute 使用了严格路由，下一跳是 Request-URI
+	strictRoute bool
 	// 事务的key
 	tKey strings.Builder
 }
@@ -78,6 +82,9 @@ func (m *Message) FormatTo(writer Writer) error {
 // start line 的 [0][2] 转换为大写
 // CSeq 的 method 转换为大写
 func (m *Message) ParseFrom(reader Reader, max int) (err error) {
+	if max < 1 {
+		max = math.MaxInt
+	}
 	// start line
 	max, err = m.parseStartLine(reader, max)
 	if err != nil {
@@ -124,7 +131,7 @@ func (m *Message) parseStartLine(reader Reader, max int) (int, error) {
 	if i < 0 {
 		return max, errStartLineFormat
 	}
-	m.StartLine[1] = strings.ToUpper(line[:i])
+	m.StartLine[1] = line[:i]
 	// 2
 	m.StartLine[2] = strings.TrimSpace(line[i+1:])
 	// 检查
@@ -136,16 +143,61 @@ func (m *Message) parseStartLine(reader Reader, max int) (int, error) {
 	return max, nil
 }
 
-// TransactionKey 返回事务的 key
+// TransactionKey 返回服务端事务的 key ，RFC 3261 17.2.3 。
+// ACK 和 INVITE 的相同，用于匹配非 2xx 响应的 ACK ，CANCEL 是单独的事务。
+// branch 以 z9hG4bK 开头的，使用 method branch sent-by ，
+// 否则是 RFC 2543 的请求，使用 method Request-URI From.tag Call-ID CSeq.SN 和 Via 。
+// 各部分使用 | 分隔，它不会出现在这些字段中，key 可以直接用于日志和错误
 func (m *Message) TransactionKey() string {
 	if m.tKey.Len() < 1 {
-		m.tKey.WriteString(m.Header.CSeq.Method)
-		m.tKey.WriteString(m.Header.CallID)
-		m.tKey.WriteString(m.Header.Via[0].Branch)
+		method := m.Header.CSeq.Method
+		if method == MethodACK {
+			method = MethodInvite
+		}
+		m.tKey.WriteString(m.transactionKey(method))
 	}
 	return m.tKey.String()
 }
 
+// clientTransactionKey 返回客户端事务的 key ，响应使用它匹配客户端事务，RFC 3261 17.1.3 。
+// 自己发送的请求都有 z9hG4bK ，不需要 RFC 2543 的匹配
+func (m *Message) clientTransactionKey() string {
+	return m.branchTransactionKey(m.Header.CSeq.Method)
+}
+
+// transactionKey 返回 method 的事务的 key ，用于 CANCEL 匹配 INVITE
+func (m *Message) transactionKey(method string) string {
+	if !m.isRequest || len(m.Header.Via) < 1 || strings.HasPrefix(m.Header.Via[0].Branch, BranchPrefix) {
+		return m.branchTransactionKey(method)
+	}
+	// RFC 2543 ，To.tag 在 INVITE 中是没有的，而 ACK 和 CANCEL 可能有，所以不使用
+	via := &m.Header.Via[0]
+	var str strings.Builder
+	str.WriteString(method)
+	str.WriteByte('|')
+	str.WriteString(m.RequestURI())
+	str.WriteByte('|')
+	str.WriteString(m.Header.From.Tag)
+	str.WriteByte('|')
+	str.WriteString(m.Header.CallID)
+	str.WriteByte('|')
+	str.WriteString(strconv.FormatUint(uint64(m.Header.CSeq.SN), 10))
+	str.WriteByte('|')
+	str.WriteString(strings.ToLower(via.Address))
+	str.WriteByte('|')
+	str.WriteString(via.Branch)
+	return str.String()
+}
+
+// branchTransactionKey 返回使用 method branch sent-by 的 key ，没有 Via 不会 panic
+func (m *Message) branchTransactionKey(method string) string {
+	if len(m.Header.Via) < 1 {
+		return method
+	}
+	via := &m.Header.Via[0]
+	return method + "|" + via.Branch + "|" + strings.ToLower(via.Address)
+}
+
 // String 返回格式化后的字符串。
 func (m *Message) String() string {
 	var str strings.Builder
@@ -156,6 +208,7 @@ func (m *Message) String() string {
 // Reset 重置所有字段
 func (m *Message) Reset() {
 	m.isRequest = false
+	m.strictRoute = false
 	m.tKey.Reset()
 	for i := 0; i < 3; i++ {
 		m.StartLine[i] = ""
@@ -171,8 +224,10 @@ func (m *Message) KeepBasicHeaders() {
 	m.Body.Reset()
 }
 
-// CopyTo 拷贝字段到 mm 。
+// CopyTo 拷贝字段到 mm ，包括是否请求消息。
 func (m *Message) CopyTo(mm *Message) {
+	mm.isRequest = m.isRequest
+	mm.strictRoute = m.strictRoute
 	mm.StartLine = m.StartLine
 	m.Header.CopyTo(&mm.Header)
 	mm.Body.Write(m.Body.Bytes())
@@ -183,6 +238,14 @@ func (m *Message) IsRequest() bool {
 	return m.isRequest
 }
 
+// statusClass 返回响应状态码的第一个字符，比如 '1' 表示 1xx
+func (m *Message) statusClass() byte {
+	if m.StartLine[1] == "" {
+		return 0
+	}
+	return m.StartLine[1][0]
+}
+
 // IsStatus 返回是否与 code 相等，因为 StartLine[1] 不好记忆
 func (m *Message) IsStatus(code string) bool {
 	return m.StartLine[1] == code
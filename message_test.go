@@ -2,12 +2,13 @@ package sip
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 )
 
 func Test_Message(t *testing.T) {
 	var b bytes.Buffer
-	b.WriteString("INVITE sip:bob@biloxi.com SIP/2.0\r\n")
+	b.WriteString("invite sip:Bob@Biloxi.com;transport=tcp SIP/2.0\r\n")
 	b.WriteString("Via: SIP/2.0/UDP pc1.atlanta.com;branch=z9hG4bK776asdhds\r\n")
 	b.WriteString("Via: SIP/2.0/UDP pc2.atlanta.com\r\n")
 	b.WriteString("Max-Forwards: 70\r\n")
@@ -27,8 +28,80 @@ func Test_Message(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// 只有 method 是大写的
+	if msg.RequestMethod() != MethodInvite || msg.RequestURI() != "sip:Bob@Biloxi.com;transport=tcp" {
+		t.FailNow()
+	}
 	// header_test.go 测试过 header
 	if msg.Body.String() != "12345" {
 		t.FailNow()
 	}
 }
+
+func Test_Message_TransactionKey(t *testing.T) {
+	parse := func(startLine, via, method, toTag string) *Message {
+		var b bytes.Buffer
+		b.WriteString(startLine + "\r\n")
+		b.WriteString("Via: " + via + "\r\n")
+		b.WriteString("Max-Forwards: 70\r\n")
+		b.WriteString("To: Bob <sip:bob@biloxi.com>" + toTag + "\r\n")
+		b.WriteString("From: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n")
+		b.WriteString("Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n")
+		b.WriteString("CSeq: 314159 " + method + "\r\n")
+		b.WriteString("\r\n")
+		var msg Message
+		err := msg.ParseFrom(NewReader(&b, -1), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &msg
+	}
+	// RFC 3261
+	via := "SIP/2.0/UDP pc1.atlanta.com;branch=z9hG4bK776asdhds"
+	invite := parse("INVITE sip:bob@biloxi.com SIP/2.0", via, MethodInvite, "")
+	ack := parse("ACK sip:bob@biloxi.com SIP/2.0", via, MethodACK, ";tag=a6c85cf")
+	cancel := parse("CANCEL sip:bob@biloxi.com SIP/2.0", via, MethodCancel, "")
+	if invite.TransactionKey() != ack.TransactionKey() {
+		t.FailNow()
+	}
+	if invite.TransactionKey() == cancel.TransactionKey() {
+		t.FailNow()
+	}
+	if invite.TransactionKey() != cancel.transactionKey(MethodInvite) {
+		t.FailNow()
+	}
+	// sent-by 不同
+	other := parse("INVITE sip:bob@biloxi.com SIP/2.0", "SIP/2.0/UDP pc2.atlanta.com;branch=z9hG4bK776asdhds", MethodInvite, "")
+	if invite.TransactionKey() == other.TransactionKey() {
+		t.FailNow()
+	}
+	// RFC 2543
+	via = "SIP/2.0/UDP pc1.atlanta.com;branch=776asdhds"
+	invite = parse("INVITE sip:bob@biloxi.com SIP/2.0", via, MethodInvite, "")
+	ack = parse("ACK sip:bob@biloxi.com SIP/2.0", via, MethodACK, ";tag=a6c85cf")
+	cancel = parse("CANCEL sip:bob@biloxi.com SIP/2.0", via, MethodCancel, "")
+	if invite.TransactionKey() != ack.TransactionKey() {
+		t.FailNow()
+	}
+	if invite.TransactionKey() != cancel.transactionKey(MethodInvite) {
+		t.FailNow()
+	}
+	other = parse("INVITE sip:carol@biloxi.com SIP/2.0", via, MethodInvite, "")
+	if invite.TransactionKey() == other.TransactionKey() {
+		t.FailNow()
+	}
+	// 可以打印在一行
+	e := &TransactionError{Key: invite.TransactionKey(), Err: ErrTransactionExists}
+	if strings.Contains(e.Error(), "\n") {
+		t.Fatal(e.Error())
+	}
+	// 拷贝的请求，key 不变
+	var cp Message
+	invite.CopyTo(&cp)
+	if !cp.IsRequest() || cp.TransactionKey() != invite.TransactionKey() {
+		t.FailNow()
+	}
+	// 没有 Via
+	var msg Message
+	msg.TransactionKey()
+}
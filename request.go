@@ -2,6 +2,7 @@ package sip
 
 import (
 	"context"
+	"strings"
 
 	"github.com/qq51529210/uuid"
 )
@@ -11,43 +12,125 @@ type Request struct {
 	transaction
 	*Message
 	Conn
+	// 收到 CANCEL 或者事务结束时取消
 	context.Context
-	s *Server
+	// 请求所属的对话，不在对话表中为 nil
+	Dialog *Dialog
+	s      *Server
 }
 
-// Response 改造当前的请求消息，添加 to.tag 和 via 的 rport 和 received
-// 变为响应消息，然后使用当前的 conn 发送
+// NewResponse 返回当前请求的响应消息，不会修改请求消息。
+// To 没有 tag 的，除了 100 ，添加一个同一个事务中不变的 tag 。
+// 收到请求时已经处理了 Via 的 received 和 rport
+func (r *Request) NewResponse(status, phrase string) *Message {
+	res := NewResponse(r.Message, status, phrase)
+	// 给 To 加个 tag
+	if res.Header.To.Tag == "" && status != StatusTrying {
+		if t, ok := r.transaction.(*serverTransaction); ok {
+			res.Header.To.Tag = t.getToTag()
+		} else {
+			res.Header.To.Tag = uuid.SnowflakeIDString()
+		}
+	}
+	return res
+}
+
+// WriteResponse 使用当前的事务发送响应消息 res ，
+// 可以发送多个 1xx ，发送了最终响应后返回错误
+func (r *Request) WriteResponse(res *Message) error {
+	return r.transaction.writeMessage(r.Conn, res)
+}
+
+// Response 使用 NewResponse 生成响应消息，然后使用当前的 conn 发送
 func (r *Request) Response(status, phrase string) error {
-	if phrase == "" {
-		phrase = StatusPhrase(status)
-	}
-	r.InitStartLineOfResponse(status, phrase)
-	if r.Message.Header.Via[0].RProt != nil {
-		if r.Header.Via[0].RProt != nil {
-			ip := r.RemoteIP()
-			r.Header.Via[0].Received = &ip
-			port := r.RemotePort()
-			r.Header.Via[0].RProt = &port
+	return r.WriteResponse(r.NewResponse(status, phrase))
+}
+
+// RequestOption 是 Server.NewRequest 的选项
+type RequestOption func(*Message)
+
+// WithTransport 设置 Via 的传输协议，默认是 UDP ，发送时和连接的 UDP 或者 TCP 一致，
+// 用于在 tcp 连接上指定 TLS 等
+func WithTransport(proto string) RequestOption {
+	return func(m *Message) {
+		m.Header.Via[0].Proto = strings.ToUpper(proto)
+	}
+}
+
+// WithContact 添加一个 Contact ，uri 的 Address 为空使用 AddrPort
+func WithContact(contact URI) RequestOption {
+	return func(m *Message) {
+		m.Header.Contact = append(m.Header.Contact, Contact{})
+		contact.CopyTo(&m.Header.Contact[len(m.Header.Contact)-1].URI)
+	}
+}
+
+// WithBody 设置 Content-Type 和 body
+func WithBody(contentType string, body []byte) RequestOption {
+	return func(m *Message) {
+		m.Header.ContentType = contentType
+		m.Body.Reset()
+		m.Body.Write(body)
+	}
+}
+
+// WithRoute 设置预加载的路由，RFC 3261 8.1.1.1 ，
+// 第一个路由是严格路由的，Request-URI 会被替换，见 Message.SetRoute
+func WithRoute(routes ...Address) RequestOption {
+	return func(m *Message) {
+		var target URI
+		if target.Parse(m.RequestURI()) == nil {
+			m.SetRoute(routes, &target)
 		}
-		// if r.s.received != "" {
-		// 	r.Header.Via[0].Received = &r.s.received
-		// } else {
-		// 	ip := r.RemoteIP()
-		// 	r.Header.Via[0].Received = &ip
-		// }
-		// if r.s.rport != "" {
-		// 	r.Header.Via[0].RProt = &r.s.rport
-		// } else {
-		// 	port := r.RemotePort()
-		// 	r.Header.Via[0].RProt = &port
-		// }
 	}
-	// 给 To 加个 tag
-	if r.Header.To.Tag == "" {
-		r.Header.To.Tag = uuid.SnowflakeIDString()
+}
+
+// WithHeader 添加一个其他的头
+func WithHeader(key, value string) RequestOption {
+	return func(m *Message) {
+		m.Header.Others = append(m.Header.Others, KV{Key: key, Value: value})
+	}
+}
+
+// NewRequest 返回一个新的请求，生成 Call-ID 、From 的 tag 、branch 和 CSeq ，
+// Max-Forwards 是 70 ，Via 的 sent-by 是 AddrPort ，并且带有 rport ，RFC 3581 。
+// 开启了 LearnPublicAddr 的，发送时替换为对方看到的公网地址。
+// from 有 tag 的不会覆盖，to 的 tag 保持原样
+func (s *Server) NewRequest(method, requestURI string, from, to Address, opts ...RequestOption) *Message {
+	m := new(Message)
+	m.isRequest = true
+	m.InitStartLineOfRequest(method, requestURI)
+	// From To
+	from.CopyTo(&m.Header.From)
+	if m.Header.From.Tag == "" {
+		m.Header.From.Tag = uuid.SnowflakeIDString()
+	}
+	to.CopyTo(&m.Header.To)
+	// 其他
+	m.Header.CallID = uuid.SnowflakeIDString()
+	m.Header.CSeq.SN = GetCSeq()
+	m.Header.CSeq.Method = method
+	m.Header.MaxForwards.Set(70)
+	// Via 和选项
+	s.initRequest(m, opts)
+	return m
+}
+
+// initRequest 添加 Via ，然后应用选项 opts ，再填充 Contact 的地址，都使用 AddrPort
+func (s *Server) initRequest(m *Message, opts []RequestOption) {
+	addr := s.AddrPort
+	// Via
+	rport := ""
+	m.Header.Via = append(m.Header.Via, NewVia("UDP", addr, &rport, nil))
+	// 选项
+	for _, opt := range opts {
+		opt(m)
+	}
+	// Contact
+	for i := 0; i < len(m.Header.Contact); i++ {
+		c := &m.Header.Contact[i]
+		if !c.Star && c.URI.Scheme != "" && c.URI.Address == "" {
+			c.URI.Address = addr
+		}
 	}
-	// 设置 Agent 和 body
-	r.Header.UserAgent = ""
-	// 发送
-	return r.transaction.writeMessage(r.Conn, r.Message)
 }
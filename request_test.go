@@ -0,0 +1,48 @@
+package sip
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Server_NewRequest(t *testing.T) {
+	s := &Server{AddrPort: "192.168.1.2:5060"}
+	var from, to Address
+	from.Parse("<sip:alice@atlanta.com>")
+	to.Parse("<sip:bob@biloxi.com>")
+	var contact URI
+	contact.Parse("<sip:alice@192.168.1.2:5060>")
+	m := s.NewRequest(MethodMessage, "sip:bob@biloxi.com", from, to,
+		WithTransport("tcp"), WithContact(contact),
+		WithBody("Application/MANSCDP+xml", []byte("<Query/>")),
+		WithHeader("Subject", "test"))
+	// 格式化后解析
+	var b bytes.Buffer
+	m.FormatTo(&b)
+	var msg Message
+	err := msg.ParseFrom(NewReader(&b, -1), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.RequestMethod() != MethodMessage || msg.RequestURI() != "sip:bob@biloxi.com" {
+		t.FailNow()
+	}
+	if len(msg.Header.Via) != 1 || msg.Header.Via[0].Proto != "TCP" ||
+		msg.Header.Via[0].Address != s.AddrPort || msg.Header.Via[0].Branch == "" {
+		t.FailNow()
+	}
+	if msg.Header.From.Tag == "" || msg.Header.To.Tag != "" || msg.Header.CallID == "" {
+		t.FailNow()
+	}
+	if msg.Header.CSeq.Method != MethodMessage || msg.Header.CSeq.SN == 0 || msg.Header.MaxForwards.n != 70 {
+		t.FailNow()
+	}
+	if msg.Header.Contact[0].URI.Address != "192.168.1.2:5060" || msg.Body.String() != "<Query/>" {
+		t.FailNow()
+	}
+	// 填充 Contact 的地址
+	m = s.NewRequest(MethodRegister, "sip:biloxi.com", from, to, WithContact(URI{Scheme: "sip", Name: "alice"}))
+	if m.Header.Via[0].Address != s.AddrPort || m.Header.Contact[0].URI.Address != s.AddrPort {
+		t.FailNow()
+	}
+}
@@ -1,6 +1,9 @@
 package sip
 
-import "context"
+import (
+	"context"
+	"strings"
+)
 
 // Response 表示响应消息
 type Response struct {
@@ -10,3 +13,36 @@ type Response struct {
 	context.Context
 	s *Server
 }
+
+// NewResponse 根据请求 req 返回一个新的响应消息，不会修改 req ，RFC 3261 8.2.6 。
+// 拷贝 Via 、From 、To 、Call-ID 、CSeq 、Timestamp 和 Record-Route ，
+// phrase 为空使用 StatusPhrase 。To 的 tag 保持原样，Request.NewResponse 会添加
+func NewResponse(req *Message, status, phrase string) *Message {
+	res := new(Message)
+	res.initResponse(req, status, phrase)
+	return res
+}
+
+// initResponse 根据请求 req 初始化响应消息
+func (m *Message) initResponse(req *Message, status, phrase string) {
+	if phrase == "" {
+		phrase = StatusPhrase(status)
+	}
+	m.InitStartLineOfResponse(status, phrase)
+	m.Header.Via = m.Header.Via[:0]
+	for i := 0; i < len(req.Header.Via); i++ {
+		m.Header.Via = append(m.Header.Via, Via{})
+		req.Header.Via[i].CopyTo(&m.Header.Via[i])
+	}
+	req.Header.From.CopyTo(&m.Header.From)
+	req.Header.To.CopyTo(&m.Header.To)
+	m.Header.CallID = req.Header.CallID
+	m.Header.CSeq.SN = req.Header.CSeq.SN
+	m.Header.CSeq.Method = req.Header.CSeq.Method
+	m.Header.RecordRoute = copyAddresses(m.Header.RecordRoute[:0], req.Header.RecordRoute)
+	for i := 0; i < len(req.Header.Others); i++ {
+		if strings.EqualFold(req.Header.Others[i].Key, "Timestamp") {
+			m.Header.Others = append(m.Header.Others, req.Header.Others[i])
+		}
+	}
+}
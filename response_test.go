@@ -0,0 +1,50 @@
+package sip
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_NewResponse(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("INVITE sip:bob@biloxi.com SIP/2.0\r\n")
+	b.WriteString("Via: SIP/2.0/UDP pc1.atlanta.com;branch=z9hG4bK776asdhds\r\n")
+	b.WriteString("Via: SIP/2.0/UDP pc2.atlanta.com;branch=z9hG4bK776asdhdt\r\n")
+	b.WriteString("Max-Forwards: 70\r\n")
+	b.WriteString("To: Bob <sip:bob@biloxi.com>\r\n")
+	b.WriteString("From: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n")
+	b.WriteString("Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n")
+	b.WriteString("CSeq: 314159 INVITE\r\n")
+	b.WriteString("Record-Route: <sip:p1.example.com;lr>\r\n")
+	b.WriteString("Timestamp: 54\r\n")
+	b.WriteString("\r\n")
+	var req Message
+	err := req.ParseFrom(NewReader(&b, -1), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := NewResponse(&req, StatusOK, "")
+	res.Header.To.Tag = "abc"
+	// 请求没有变化
+	if req.RequestMethod() != MethodInvite || req.Header.To.Tag != "" {
+		t.FailNow()
+	}
+	if res.ResponseStatus() != StatusOK || res.ResponsePhrase() != StatusPhrase(StatusOK) {
+		t.FailNow()
+	}
+	if len(res.Header.Via) != 2 || res.Header.Via[1].Branch != "z9hG4bK776asdhdt" {
+		t.FailNow()
+	}
+	// Via 不共享
+	res.Header.Via[0].SetParam("ttl", "9")
+	if _, ok := req.Header.Via[0].Param("ttl"); ok {
+		t.FailNow()
+	}
+	if res.Header.From.Tag != "1928301774" || res.Header.CallID != req.Header.CallID ||
+		res.Header.CSeq.SN != 314159 || res.Header.CSeq.Method != MethodInvite {
+		t.FailNow()
+	}
+	if len(res.Header.RecordRoute) != 1 {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,108 @@
+package sip
+
+import (
+	"net"
+	"strings"
+)
+
+// isLooseRoute 返回路由的 uri 是否带有 lr 参数，RFC 3261 19.1.1
+func isLooseRoute(u *URI) bool {
+	_, ok := u.Param("lr")
+	return ok
+}
+
+// SetRoute 使用路由集合 routes 和目标 target 设置请求的 Request-URI 和 Route ，RFC 3261 12.2.1.1 。
+// 没有路由，Request-URI 是 target 。第一个是松散路由（有 lr ），Request-URI 是 target ，
+// Route 是 routes 。第一个是严格路由，Request-URI 是第一个路由的 uri ，
+// Route 是剩下的路由，最后加上 target
+func (m *Message) SetRoute(routes []Address, target *URI) {
+	m.Header.Route = m.Header.Route[:0]
+	m.strictRoute = false
+	if len(routes) < 1 {
+		m.StartLine[1] = target.requestURI()
+		return
+	}
+	if isLooseRoute(&routes[0].URI) {
+		m.StartLine[1] = target.requestURI()
+		m.Header.Route = copyAddresses(m.Header.Route, routes)
+		return
+	}
+	// 严格路由，去掉 Request-URI 不允许的头
+	m.strictRoute = true
+	m.StartLine[1] = routes[0].URI.requestURI()
+	m.Header.Route = copyAddresses(m.Header.Route, routes[1:])
+	m.Header.Route = append(m.Header.Route, Address{})
+	target.CopyTo(&m.Header.Route[len(m.Header.Route)-1].URI)
+}
+
+// NextHop 返回请求的下一跳，RFC 3261 8.1.2 。
+// SetRoute 使用了严格路由的，Request-URI 已经是第一个路由了，使用 Request-URI ，
+// 否则第一个 Route 是松散路由的，使用它的 uri ，其他使用 Request-URI
+func (m *Message) NextHop() (URI, error) {
+	var u URI
+	if !m.strictRoute && len(m.Header.Route) > 0 && isLooseRoute(&m.Header.Route[0].URI) {
+		m.Header.Route[0].URI.CopyTo(&u)
+		return u, nil
+	}
+	return u, u.Parse(m.RequestURI())
+}
+
+// ResolveNextHop 使用 NextHop 和 ResolveAddr 返回请求 msg 的下一跳的地址，
+// 可以用于 SendRequest 和 Do
+func (s *Server) ResolveNextHop(msg *Message) (net.Addr, error) {
+	u, err := msg.NextHop()
+	if err != nil {
+		return nil, err
+	}
+	return s.ResolveAddr(&u)
+}
+
+// popRoute 处理收到的请求的 Route ，RFC 3261 16.4 。
+// Request-URI 是自己的并且有 lr 参数，说明上一跳是严格路由，
+// 它是我们的 Record-Route ，使用最后一个 Route 替换 Request-URI 。
+// 然后第一个 Route 是自己的，移除它
+func (s *Server) popRoute(msg *Message) {
+	if len(msg.Header.Route) < 1 {
+		return
+	}
+	// 严格路由
+	var u URI
+	if u.Parse(msg.RequestURI()) == nil && isLooseRoute(&u) && s.isLocalURI(&u) {
+		n := len(msg.Header.Route) - 1
+		msg.StartLine[1] = msg.Header.Route[n].URI.requestURI()
+		msg.Header.Route = msg.Header.Route[:n]
+		if len(msg.Header.Route) < 1 {
+			return
+		}
+	}
+	// 松散路由
+	if s.isLocalURI(&msg.Header.Route[0].URI) {
+		msg.Header.Route = append(msg.Header.Route[:0], msg.Header.Route[1:]...)
+	}
+}
+
+// isLocalURI 返回 u 的 host:port 是否 AddrPort 或者学习到的公网地址，没有端口的使用默认端口
+func (s *Server) isLocalURI(u *URI) bool {
+	port := u.Port()
+	if port == "" {
+		port = DefaultPort
+		if u.IsSecure() || u.Transport() == TransportTLS {
+			port = DefaultTLSPort
+		}
+	}
+	addrs := []string{s.AddrPort}
+	s.publicAddr.Range(func(_, v any) bool {
+		addrs = append(addrs, v.(string))
+		return true
+	})
+	for _, addr := range addrs {
+		h, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(h, u.Host()) && p == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package sip
+
+import "testing"
+
+func Test_Message_SetRoute(t *testing.T) {
+	var target URI
+	err := target.Parse("sip:bob@192.0.2.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := make([]Address, 2)
+	routes[0].Parse("<sip:p1.example.com;lr>")
+	routes[1].Parse("<sip:p2.example.com;lr>")
+	// 松散路由
+	var m Message
+	m.InitStartLineOfRequest(MethodBye, "")
+	m.SetRoute(routes, &target)
+	if m.RequestURI() != "sip:bob@192.0.2.4" || len(m.Header.Route) != 2 {
+		t.FailNow()
+	}
+	hop, err := m.NextHop()
+	if err != nil || hop.Address != "p1.example.com" {
+		t.FailNow()
+	}
+	// 严格路由
+	routes[0].Parse("<sip:p1.example.com;transport=tcp?x=1>")
+	m.SetRoute(routes, &target)
+	if m.RequestURI() != "sip:p1.example.com;transport=tcp" || len(m.Header.Route) != 2 ||
+		m.Header.Route[0].URI.Address != "p2.example.com" || m.Header.Route[1].URI.String() != "sip:bob@192.0.2.4" {
+		t.Fatal(m.RequestURI())
+	}
+	hop, err = m.NextHop()
+	if err != nil || hop.Address != "p1.example.com" || hop.Transport() != "tcp" {
+		t.FailNow()
+	}
+	// 没有路由
+	m.SetRoute(nil, &target)
+	if m.RequestURI() != "sip:bob@192.0.2.4" || len(m.Header.Route) != 0 {
+		t.FailNow()
+	}
+}
+
+func Test_Server_popRoute(t *testing.T) {
+	var s Server
+	s.AddrPort = "192.168.1.2:5060"
+	// 第一个是自己
+	var m Message
+	m.InitStartLineOfRequest(MethodBye, "sip:bob@192.0.2.4")
+	m.Header.Route = make([]Address, 2)
+	m.Header.Route[0].Parse("<sip:192.168.1.2;lr>")
+	m.Header.Route[1].Parse("<sip:p2.example.com;lr>")
+	s.popRoute(&m)
+	if len(m.Header.Route) != 1 || m.Header.Route[0].URI.Address != "p2.example.com" {
+		t.FailNow()
+	}
+	// 不是自己
+	s.popRoute(&m)
+	if len(m.Header.Route) != 1 {
+		t.FailNow()
+	}
+	// 上一跳是严格路由
+	m.InitStartLineOfRequest(MethodBye, "sip:192.168.1.2:5060;lr")
+	m.Header.Route = m.Header.Route[:0]
+	m.Header.Route = append(m.Header.Route, Address{}, Address{})
+	m.Header.Route[0].Parse("<sip:p2.example.com;lr>")
+	m.Header.Route[1].Parse("<sip:bob@192.0.2.4>")
+	s.popRoute(&m)
+	if m.RequestURI() != "sip:bob@192.0.2.4" || len(m.Header.Route) != 1 || m.Header.Route[0].URI.Address != "p2.example.com" {
+		t.Fatal(m.RequestURI())
+	}
+}
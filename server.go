@@ -20,8 +20,18 @@ const (
 	DefaultWriteTimeout = time.Second * 10
 	// 默认的每个 udp 连接的数据包缓存队列长度
 	DefaultUDPDataQueueLen = 16
-	// 最小的超时重发
-	MinRTO = time.Millisecond * 200
+	// RTT 的估计值，RFC 3261 的 T1
+	DefaultT1 = time.Millisecond * 500
+	// 非 INVITE 请求和 INVITE 响应的最大重发间隔，RFC 3261 的 T2
+	DefaultT2 = time.Second * 4
+	// 消息在网络中存留的最长时间，RFC 3261 的 T4
+	DefaultT4 = time.Second * 5
+	// 不可靠传输时，INVITE 客户端事务等待重发的最终响应的时间，RFC 3261 的 Timer D
+	DefaultTimerD = time.Second * 32
+	// INVITE 服务端事务等待最终响应的时间，超时回应 408 ，RFC 3261 16.6 的 Timer C
+	DefaultTimerC = time.Minute * 3
+	// INVITE 服务端事务在 Handler 没有发送响应时，自动回应 100 的等待时间，RFC 3261 17.2.1
+	TryingDelay = time.Millisecond * 200
 )
 
 const (
@@ -38,46 +48,65 @@ var (
 	errConnClosed = errors.New("conn closed")
 	// 地址类型不对
 	errAddrType = errors.New("error net.Addr type")
-	// 发送请求生成事务发现事务已经存在
-	errTransactionExists = errors.New("transaction exists")
+	// 事务不存在或者已经结束
+	errTransactionNotExists = errors.New("transaction not exists")
+	// 只能取消 INVITE
+	errCancelNotInvite = errors.New("only INVITE can be canceled")
+	errACKResponse     = errors.New("ACK can not be responded")
 )
 
 // Handler 是处理消息的接口
 type Handler interface {
-	// 返回 true 表示已经处理好当前消息，递增 sn
+	// 处理收到的请求，可以返回后再异步发送响应，
+	// 在最终响应之前，事务保持到 Timer C（INVITE）或者 64*T1（非 INVITE）
 	HandleRequest(*Request)
-	// 返回值暂时没意义，先这样
+	// 处理主动发起的事务的响应，同一个事务的 1xx 和最终响应按顺序回调，
+	// 重发的响应不会回调。INVITE 在第一个 2xx 之后，分叉的 2xx 也会回调，
+	// 需要为每一个发送 ACK ，已经 ACK 的 2xx 重发时，事务会重发 ACK 。
+	// 在事务协程中调用，不要阻塞
 	HandleResponse(*Response)
 }
 
+// ACKHandler 是 Handler 的可选接口，实现了它就可以收到 2xx 响应的 ACK ，
+// 没有实现时，使用 HandleRequest 回调。ACK 不能响应。
+type ACKHandler interface {
+	HandleACK(*Request)
+}
+
 // Server 表示 sip 服务
 type Server struct {
 	// 监听端口
 	Port int
 	// 网关 的地址，有时候不想让别人知道在 nat 后面，隐藏内网地址
 	AddrPort string
+	// 是否从响应的 Via 的 received 和 rport 按对方地址学习自己的公网地址，RFC 3581 9 。
+	// 开启后，发往学习过的地址的请求，Via 的 sent-by 和 Contact 使用学习到的地址，而不是 AddrPort
+	LearnPublicAddr bool
 	// 最小是 UDPMinDataLen ，最大是 UDPMaxDataLen
 	MessageLen int
 	// 每个 udp 连接的数据包缓存队列长度，默认是 DefaultUDPDataQueueLen
 	UDPDataQueueLen int
-	// 读取消息的超时，也是事务的超时时间，毫秒。默认是 DefaultReadTimeout
+	// 读取消息的超时，毫秒。默认是 DefaultReadTimeout 。
+	// 事务的超时由 Timer 决定（64*T1），和它无关
 	ReadTimeout time.Duration
 	// 发送消息的超时，毫秒。默认是 DefaultWriteTimeout
 	WriteTimeout time.Duration
-	// sip 事务失效的超时时间，单位毫秒。默认是 DefaultTransactionTimeout
-	// TransactionTimeout time.Duration
-	// sip 消息重发间隔，单位毫秒，UDP 使用。默认是 DefaultTransactionRTO
-	// TransactionRTO time.Duration
+	// 事务的定时器，默认是 RFC 3261 的值，可以使用 SetTargetTimer 按地址覆盖
+	Timer Timer
 	// 回调函数
 	Handler Handler
-	// udp 超时重发
-	rto time.Duration
+	// 按地址设置的 timer
+	targetTimer map[string]Timer
+	// targetTimer 的锁
+	timerLock sync.RWMutex
 	// 用于同步等待协程退出
 	wg sync.WaitGroup
-	// tcp 事务
-	tcptx tcpTransactions
-	// udp 事务
-	udptx udpTransactions
+	// 客户端事务
+	clienttx clientTransactions
+	// 服务端事务
+	servertx serverTransactions
+	// 对话表
+	dialogs dialogs
 	// tcp 监听
 	tcpListener *net.TCPListener
 	// tcp 锁
@@ -94,20 +123,18 @@ type Server struct {
 	bufPool sync.Pool
 	// 状态，1: 正常
 	ok int32
-	// received 的值，隐藏内网地址
-	received string
-	// rport 的值，隐藏内网地址
-	rport string
+	// 退出信号，用于通知事务协程退出
+	quit safeChan[struct{}]
+	// 从响应的 Via 学习到的公网地址，key 是对方的 ip:port
+	publicAddr sync.Map
 }
 
 // Listen 根据 opt 初始化服务
 func (s *Server) Listen() error {
-	addrPort, err := netip.ParseAddrPort(s.AddrPort)
+	_, err := netip.ParseAddrPort(s.AddrPort)
 	if err != nil {
 		return err
 	}
-	s.received = addrPort.Addr().String()
-	s.rport = fmt.Sprintf("%d", addrPort.Port())
 	// 纠正数据
 	if s.MessageLen < UDPMinDataLen {
 		s.MessageLen = UDPMinDataLen
@@ -124,13 +151,11 @@ func (s *Server) Listen() error {
 	if s.WriteTimeout < 1 {
 		s.WriteTimeout = DefaultWriteTimeout
 	}
-	s.rto = s.WriteTimeout / 3 * 3
-	if s.rto < MinRTO {
-		s.rto = MinRTO
-	}
+	s.Timer.init()
 	// 事务表
-	s.tcptx.init()
-	s.udptx.init()
+	s.clienttx.init()
+	s.servertx.init()
+	s.dialogs.init()
 	// tcp 连接池
 	s.tcpConns = make(map[connKey]*tcpConn)
 	// 缓存池
@@ -138,6 +163,7 @@ func (s *Server) Listen() error {
 	s.bufPool.New = func() any { return bytes.NewBuffer(nil) }
 	s.udpData.New = func() any { return &udpData{b: make([]byte, s.MessageLen)} }
 	// 开始服务
+	s.quit.Init(0)
 	atomic.StoreInt32(&s.ok, 1)
 	port := fmt.Sprintf(":%d", s.Port)
 	err = s.listenUDP(port)
@@ -158,6 +184,8 @@ func (s *Server) Close() error {
 	if !atomic.CompareAndSwapInt32(&s.ok, 1, 0) {
 		return errServerClosed
 	}
+	// 通知事务协程退出
+	s.quit.Close()
 	// 关闭双服务
 	s.closeUDP()
 	s.closeTCP()
@@ -181,135 +209,125 @@ func (s *Server) PutMessage(m *Message) {
 	s.msgPool.Put(m)
 }
 
-// sendUDP 发送一个新的 udp 事务请求，调用要注意 data 的资源释放。
-func (s *Server) sendUDP(ctx context.Context, conn Conn, msg *Message) error {
-	// 新的事务
-	t := s.udptx.new(msg)
-	t.ctx = ctx
-	// 数据
-	t.writeMessage(conn, msg)
-	// 事务回收计数
-	atomic.AddInt32(&t.recovery, 1)
-	// 启动发送协程
-	s.wg.Add(1)
-	go s.udpTransactionRetransmissionRoutine(ctx, conn, t)
-	//
-	return nil
-}
-
-// sendUDPTimeout 发送一个新的 udp 事务请求。
-// timeout 用于控制整个事务的超时，小于 0 则使用 s.TransactionTimeout ，调用要注意 data 的资源释放。
-func (s *Server) sendUDPTimeout(conn Conn, msg *Message, timeout time.Duration) error {
-	// 新的事务
-	t := s.udptx.new(msg)
-	// 数据
-	t.writeMessage(conn, msg)
-	// 事务回收计数
-	atomic.AddInt32(&t.recovery, 1)
-	// 启动发送协程
-	s.wg.Add(1)
-	go s.udpTransactionRetransmissionTimeoutRoutine(conn, t, timeout)
-	//
-	return nil
+// handleMessage 处理收到的消息
+func (s *Server) handleMessage(conn Conn, msg *Message) {
+	// 请求消息，交给服务端事务处理
+	if msg.isRequest {
+		setViaReceived(conn, msg)
+		s.popRoute(msg)
+		s.handleServerTransactionMessage(conn, msg)
+		return
+	}
+	// 响应消息，交给客户端事务处理
+	t := s.clienttx.get(msg.clientTransactionKey())
+	if t != nil {
+		s.learnPublicAddr(conn, msg)
+		if t.putResponse(msg) {
+			return
+		}
+	}
+	// 没有事务或者已经结束
+	s.msgPool.Put(msg)
 }
 
-// sendTCP 发送一个新的 tcp 事务请求，调用要注意 data 的资源释放。
-func (s *Server) sendTCP(ctx context.Context, conn Conn, msg *Message) error {
+// sendRequest 发送一个新的事务请求，cancel 不为 nil 时在事务结束后调用。
+// ACK 不是事务，只发送一次。
+func (s *Server) sendRequest(ctx context.Context, conn Conn, msg *Message, cancel context.CancelFunc) error {
+	if msg.Header.CSeq.Method == MethodACK {
+		if cancel != nil {
+			cancel()
+		}
+		return s.sendACK(conn, msg)
+	}
 	// 新的事务
-	t := s.tcptx.new(msg)
-	t.ctx = ctx
-	// 发送
-	err := t.writeMessage(conn, msg)
+	t, err := s.newClientTransaction(ctx, conn, msg)
 	if err != nil {
+		if cancel != nil {
+			cancel()
+		}
 		return err
 	}
-	// 事务回收计数
-	atomic.AddInt32(&t.recovery, 1)
-	// 启动超时清理协程
-	s.wg.Add(1)
-	go s.clearTCPTransactionRoutine(ctx, t)
+	// 启动事务协程
+	s.startClientTransaction(t, cancel)
 	//
 	return nil
 }
 
-// sendTCPTimeout 发送一个新的 tcp 事务请求。
-// timeout 用于控制整个事务的超时，小于 0 则使用 s.TransactionTimeout 。
-func (s *Server) sendTCPTimeout(conn Conn, msg *Message, timeout time.Duration) error {
-	// 新的事务
-	t := s.tcptx.new(msg)
-	// 发送
-	err := t.writeMessage(conn, msg)
-	if err != nil {
-		return err
+// sendRequestTimeout 发送一个新的事务请求。
+// timeout 用于控制整个事务的超时，小于 1 则由 conn 的 Timer 决定，见 Timer.transactionTimeout 。
+func (s *Server) sendRequestTimeout(conn Conn, msg *Message, timeout time.Duration) error {
+	// 超时
+	if timeout < 1 {
+		timer := s.getTimer(conn)
+		timeout = timer.transactionTimeout(msg.Header.CSeq.Method)
 	}
-	// 事务回收计数
-	atomic.AddInt32(&t.recovery, 1)
-	// 启动超时清理协程
-	s.wg.Add(1)
-	go s.handleTCPTransactionTimeoutRoutine(t, timeout)
-	//
-	return nil
+	if timeout < 1 {
+		return s.sendRequest(context.Background(), conn, msg, nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return s.sendRequest(ctx, conn, msg, cancel)
 }
 
 // SendRequest 发送一个新的事务请求。如果 addr 是 tcp 且没有相应的连接则主动发起连接，
 // ctx 在 tcp 发起连接时使用，在事务成功后，ctx 控制事务的销毁。
+// INVITE 收到 1xx 后不再有超时，需要调用者使用 ctx 控制。
+// 事务失败时，如果 Handler 实现了 ErrorHandler 则回调 HandleError ，
+// 否则超时（Timer B/F）时，Handler.HandleResponse 会收到一个本地生成的 408 响应。
 func (s *Server) SendRequest(ctx context.Context, addr net.Addr, msg *Message) error {
 	if !s.isOK() {
 		return errServerClosed
 	}
-	// tcp 地址
-	if a, ok := addr.(*net.TCPAddr); ok {
-		// 拿到/建立连接
-		conn, err := s.getTCPConn(ctx, a)
-		if err != nil {
-			return err
-		}
-		// 发送
-		return s.sendTCP(ctx, conn, msg)
-	}
-	// udp 地址
-	if a, ok := addr.(*net.UDPAddr); ok {
-		// 连接
-		conn := new(udpConn)
-		s.initUDPConn(conn, a)
-		// 发送
-		return s.sendUDP(ctx, conn, msg)
+	// 连接
+	conn, err := s.getConn(ctx, addr)
+	if err != nil {
+		return err
 	}
-	return errAddrType
+	// 发送
+	return s.sendRequest(ctx, conn, msg, nil)
 }
 
 // SendRequestTimeout 发送一个新的事务请求。
-// timeout 用于控制整个事务的超时，小于 0 则使用 s.TransactionTimeout 。
+// timeout 用于控制整个事务的超时，包括 tcp 发起连接，
+// 小于 1 则发起连接使用 s.WriteTimeout ，事务由 Timer 决定，见 SendRequestWithConnTimeout 。
 func (s *Server) SendRequestTimeout(addr net.Addr, msg *Message, timeout time.Duration) error {
 	if !s.isOK() {
 		return errServerClosed
 	}
-	// tcp 地址
-	if a, ok := addr.(*net.TCPAddr); ok {
-		// 超时
-		if timeout < 1 {
-			// timeout = s.TransactionTimeout
-			timeout = s.WriteTimeout
-		}
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-		// 拿到/建立连接
-		conn, err := s.getTCPConn(ctx, a)
+	// 超时
+	if timeout < 1 {
+		ctx, cancel := context.WithTimeout(context.Background(), s.WriteTimeout)
+		conn, err := s.getConn(ctx, addr)
+		cancel()
 		if err != nil {
 			return err
 		}
-		// 发送
-		return s.sendTCPTimeout(conn, msg, timeout)
+		return s.sendRequestTimeout(conn, msg, 0)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	// 连接
+	conn, err := s.getConn(ctx, addr)
+	if err != nil {
+		cancel()
+		return err
+	}
+	// 发送
+	return s.sendRequest(ctx, conn, msg, cancel)
+}
+
+// getConn 返回 addr 的连接，如果 addr 是 tcp 且没有相应的连接则主动发起连接
+func (s *Server) getConn(ctx context.Context, addr net.Addr) (Conn, error) {
+	// tcp 地址
+	if a, ok := addr.(*net.TCPAddr); ok {
+		// 拿到/建立连接
+		return s.getTCPConn(ctx, a)
 	}
 	// udp 地址
 	if a, ok := addr.(*net.UDPAddr); ok {
-		// 连接
 		conn := new(udpConn)
 		s.initUDPConn(conn, a)
-		// 发送
-		return s.sendUDPTimeout(conn, msg, timeout)
+		return conn, nil
 	}
-	return errAddrType
+	return nil, errAddrType
 }
 
 // SendRequestWithConn 使用当前的 conn 来发送新的事务请求，就不需要到连接表里查找了。
@@ -319,21 +337,66 @@ func (s *Server) SendRequestWithConn(ctx context.Context, conn Conn, msg *Messag
 		return errServerClosed
 	}
 	// 发送
-	if conn.isUDP() {
-		return s.sendUDP(ctx, conn, msg)
-	}
-	return s.sendTCP(ctx, conn, msg)
+	return s.sendRequest(ctx, conn, msg, nil)
 }
 
 // SendRequestWithConnTimeout 使用当前的 conn 来发送新的事务请求，就不需要到连接表里查找了。
-// timeout 用于控制整个事务的超时销毁，小于 0 则使用 s.TransactionTimeout 。
+// timeout 用于控制整个事务的超时销毁，小于 1 则由 conn 的 Timer 决定：
+// 非 INVITE 只有 Timer F ，INVITE 是 Timer C 和 Timer B 中较大的，收到 1xx 后 Timer B 停止。
 func (s *Server) SendRequestWithConnTimeout(conn Conn, msg *Message, timeout time.Duration) error {
 	if !s.isOK() {
 		return errServerClosed
 	}
 	// 发送
-	if conn.isUDP() {
-		return s.sendUDPTimeout(conn, msg, timeout)
+	return s.sendRequestTimeout(conn, msg, timeout)
+}
+
+// Do 发送一个新的事务请求，等待并返回最终响应。如果 addr 是 tcp 且没有相应的连接则主动发起连接。
+// ctx 结束时，事务也结束。事务失败返回 *TransactionError ，不会回调 ErrorHandler 。
+// 返回的消息不再使用时，可以调用 PutMessage 回收。
+// INVITE 返回第一个 2xx ，之后分叉的 2xx 回调 Handler.HandleResponse 。
+func (s *Server) Do(ctx context.Context, addr net.Addr, msg *Message) (*Message, error) {
+	return s.DoProvisional(ctx, addr, msg, nil)
+}
+
+// DoProvisional 和 Do 一样，收到 1xx 响应时回调 provisional ，
+// provisional 在事务协程中调用，不要阻塞，也不要保留消息。
+func (s *Server) DoProvisional(ctx context.Context, addr net.Addr, msg *Message, provisional func(*Message)) (*Message, error) {
+	if !s.isOK() {
+		return nil, errServerClosed
+	}
+	// 连接
+	conn, err := s.getConn(ctx, addr)
+	if err != nil {
+		return nil, &TransactionError{Key: msg.clientTransactionKey(), Err: ErrTransportFailure, Cause: err, Request: msg}
+	}
+	// 发送
+	return s.doRequest(ctx, conn, msg, provisional)
+}
+
+// DoWithConn 使用当前的 conn 来发送新的事务请求，等待并返回最终响应。
+func (s *Server) DoWithConn(ctx context.Context, conn Conn, msg *Message) (*Message, error) {
+	if !s.isOK() {
+		return nil, errServerClosed
+	}
+	return s.doRequest(ctx, conn, msg, nil)
+}
+
+// doRequest 发送一个新的事务请求，等待并返回最终响应
+func (s *Server) doRequest(ctx context.Context, conn Conn, msg *Message, provisional func(*Message)) (*Message, error) {
+	// 新的事务
+	t, err := s.newClientTransaction(ctx, conn, msg)
+	if err != nil {
+		if err == ErrTransactionExists || err == errMissingHeaderVia {
+			return nil, &TransactionError{Key: msg.clientTransactionKey(), Err: err, Request: msg, Conn: conn}
+		}
+		return nil, &TransactionError{Key: msg.clientTransactionKey(), Err: ErrTransportFailure, Cause: err, Request: msg, Conn: conn}
 	}
-	return s.sendTCPTimeout(conn, msg, timeout)
+	call := &clientCall{provisional: provisional, done: make(chan struct{})}
+	t.call = call
+	// 启动事务协程
+	s.startClientTransaction(t, nil)
+	// 等待结果
+	<-call.done
+	return call.res, call.err
 }
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net"
 	"strconv"
-	"sync/atomic"
 	"time"
 
 	"github.com/qq51529210/log"
@@ -102,49 +101,10 @@ func (s *Server) readTCPRoutine(c *tcpConn) {
 			return
 		}
 		// 处理
-		s.handleTCPMessage(c, msg)
+		s.handleMessage(c, msg)
 	}
 }
 
-// handleTCPMessage 处理 tcp 消息
-func (s *Server) handleTCPMessage(conn *tcpConn, msg *Message) {
-	// 请求消息
-	if msg.isRequest {
-		t := s.tcptx.new(msg)
-		if atomic.CompareAndSwapInt32(&t.handlingReq, 0, 1) {
-			// 回收计数
-			atomic.AddInt32(&t.recovery, 1)
-			// 启动协程处理
-			s.wg.Add(1)
-			go s.handleTCPTransactionRequestRoutine(t, conn, msg)
-			//
-			return
-		}
-	} else {
-		// 响应消息
-		t := s.tcptx.get(msg)
-		if t != nil {
-			// 预处理 1xx
-			if msg.StartLine[1] != "" && msg.StartLine[1][0] == '1' {
-				s.msgPool.Put(msg)
-				return
-			}
-			// 第一个消息
-			if atomic.CompareAndSwapInt32(&t.handlingRes, 0, 1) {
-				// 回收计数
-				atomic.AddInt32(&t.recovery, 1)
-				// 启动协程处理
-				s.wg.Add(1)
-				go s.handleTCPTransactionResponseRoutine(t, conn, msg)
-				//
-				return
-			}
-		}
-	}
-	// 已经在处理
-	s.msgPool.Put(msg)
-}
-
 // closeTCPConn 关闭并移除 c
 func (s *Server) closeTCPConn(c *tcpConn) {
 	s.tcplock.Lock()
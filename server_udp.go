@@ -6,7 +6,6 @@ import (
 	"net"
 	"runtime"
 	"strconv"
-	"sync/atomic"
 
 	"github.com/qq51529210/log"
 )
@@ -90,40 +89,10 @@ func (s *Server) handleUDPData(reader *reader, data *udpData) {
 			return
 		}
 		// 处理
-		s.handleUDPMessage(&c, msg)
+		s.handleMessage(&c, msg)
 	}
 }
 
-// handleUDPMessage 处理 udp 消息
-func (s *Server) handleUDPMessage(conn *udpConn, msg *Message) {
-	if msg.isRequest {
-		// 请求消息
-		t := s.udptx.new(msg)
-		if atomic.CompareAndSwapInt32(&t.handlingReq, 0, 1) {
-			// 事务回收计数
-			atomic.AddInt32(&t.recovery, 1)
-			s.wg.Add(1)
-			go s.handleUDPTransactionRequestRoutine(t, conn, msg)
-			return
-		}
-	} else {
-		// 响应消息
-		t := s.udptx.get(msg)
-		if t != nil {
-			// 第一个消息
-			if atomic.CompareAndSwapInt32(&t.handlingRes, 0, 1) {
-				// 事务回收计数
-				atomic.AddInt32(&t.recovery, 1)
-				s.wg.Add(1)
-				go s.handleUDPTransactionResponseRoutine(t, conn, msg)
-				return
-			}
-		}
-	}
-	// 已经在处理
-	s.msgPool.Put(msg)
-}
-
 // initUDPConn 初始化 udpConn
 func (s *Server) initUDPConn(c *udpConn, addr *net.UDPAddr) {
 	c.conn = s.udpConn
@@ -26,6 +26,10 @@ const (
 	MethodSubscribe string = "SUBSCRIBE"
 	// MethodInfo 表示 INFO 消息
 	MethodInfo string = "INFO"
+	// MethodCancel 表示 CANCEL 消息
+	MethodCancel string = "CANCEL"
+	// MethodUpdate 表示 UPDATE 消息，RFC 3311
+	MethodUpdate string = "UPDATE"
 )
 
 const (
@@ -33,6 +37,10 @@ const (
 	BranchPrefix = "z9hG4bK"
 	// SIPVersion 表示支持的sip协议版本
 	SIPVersion = "SIP/2.0"
+	// DefaultPort 表示没有端口时使用的默认端口
+	DefaultPort = "5060"
+	// DefaultTLSPort 表示 tls 没有端口时使用的默认端口
+	DefaultTLSPort = "5061"
 )
 
 var (
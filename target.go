@@ -0,0 +1,122 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	errTargetScheme    = errors.New("target uri must be sip or sips")
+	errTLSNotSupported = errors.New("tls transport not supported")
+)
+
+// 传输协议
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+	TransportTLS = "tls"
+)
+
+// ResolveTarget 根据 uri 返回发送请求的传输协议和地址 host:port ，
+// RFC 3263 4 的简化，不查询 NAPTR 和 SRV 。
+// sips 强制使用 tls ，否则使用 transport 参数，默认是 udp 。
+// 有 maddr 参数的使用 maddr 作为 host ，没有端口的，tls 使用 DefaultTLSPort ，其他使用 DefaultPort
+func ResolveTarget(u *URI) (transport, addr string, err error) {
+	if u.Scheme != "sip" && u.Scheme != "sips" {
+		return "", "", errTargetScheme
+	}
+	// 传输协议
+	transport = u.Transport()
+	if u.IsSecure() || transport == TransportTLS {
+		transport = TransportTLS
+	} else if transport != TransportTCP {
+		transport = TransportUDP
+	}
+	// host
+	host := u.Host()
+	if maddr, ok := u.Param("maddr"); ok && maddr != "" {
+		host = strings.Trim(maddr, "[]")
+	}
+	// port
+	port := u.Port()
+	if port == "" {
+		port = DefaultPort
+		if transport == TransportTLS {
+			port = DefaultTLSPort
+		}
+	}
+	return transport, net.JoinHostPort(host, port), nil
+}
+
+// ResolveAddr 使用 ResolveTarget 返回可以用于 SendRequest 和 Do 的地址，
+// 当前不支持 tls ，sips 返回错误
+func (s *Server) ResolveAddr(u *URI) (net.Addr, error) {
+	transport, addr, err := ResolveTarget(u)
+	if err != nil {
+		return nil, err
+	}
+	switch transport {
+	case TransportTCP:
+		return net.ResolveTCPAddr("tcp", addr)
+	case TransportUDP:
+		return net.ResolveUDPAddr("udp", addr)
+	}
+	return nil, errTLSNotSupported
+}
+
+// responseAddr 根据请求的第一个 Via 返回响应的目的地址 ip:port ，RFC 3261 18.2.2 ，RFC 3581 4 。
+// 有 maddr 的使用 maddr ，然后是 received ，最后是 sent-by ，
+// 不可靠传输有 rport 的使用 rport ，否则使用 sent-by 的端口，没有是 DefaultPort 或者 DefaultTLSPort
+func responseAddr(via *Via, reliable bool) string {
+	port := via.Port()
+	if port == "" {
+		port = DefaultPort
+		if strings.EqualFold(via.Proto, TransportTLS) {
+			port = DefaultTLSPort
+		}
+	}
+	// maddr
+	if via.MAddr != "" {
+		return net.JoinHostPort(via.MAddr, port)
+	}
+	// received
+	host := via.Host()
+	if via.Received != nil && *via.Received != "" {
+		host = *via.Received
+	}
+	// rport
+	if !reliable && via.RProt != nil && *via.RProt != "" {
+		port = *via.RProt
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// responseConn 返回发送 msg 的响应的连接，msg 是从 conn 收到的请求。
+// udp 的地址和 conn 不同，返回一个新的 udpConn ；tcp 返回 conn ，发送失败时再使用 dialResponseConn 重连
+func (s *Server) responseConn(conn Conn, msg *Message) Conn {
+	if !conn.isUDP() || len(msg.Header.Via) < 1 {
+		return conn
+	}
+	addr := responseAddr(&msg.Header.Via[0], false)
+	if addr == conn.RemoteAddrString() {
+		return conn
+	}
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return conn
+	}
+	c := new(udpConn)
+	s.initUDPConn(c, a)
+	return c
+}
+
+// dialResponseConn 在原来的 tcp 连接断开后，根据请求 msg 的第一个 Via 建立新的连接
+func (s *Server) dialResponseConn(ctx context.Context, msg *Message) (Conn, error) {
+	a, err := net.ResolveTCPAddr("tcp", responseAddr(&msg.Header.Via[0], true))
+	if err != nil {
+		return nil, err
+	}
+	return s.getTCPConn(ctx, a)
+}
@@ -0,0 +1,54 @@
+package sip
+
+import "testing"
+
+func Test_ResponseAddr(t *testing.T) {
+	for _, c := range []struct {
+		via      string
+		reliable bool
+		addr     string
+	}{
+		{`SIP/2.0/UDP pc1.atlanta.com;branch=z9hG4bK776asdhds`, false, "pc1.atlanta.com:5060"},
+		{`SIP/2.0/UDP pc1.atlanta.com:5070;branch=z9hG4bK776asdhds;received=1.2.3.4`, false, "1.2.3.4:5070"},
+		{`SIP/2.0/UDP pc1.atlanta.com:5070;rport=6000;branch=z9hG4bK776asdhds;received=1.2.3.4`, false, "1.2.3.4:6000"},
+		{`SIP/2.0/TCP pc1.atlanta.com:5070;rport=6000;branch=z9hG4bK776asdhds;received=1.2.3.4`, true, "1.2.3.4:5070"},
+		{`SIP/2.0/UDP pc1.atlanta.com;branch=z9hG4bK776asdhds;maddr=224.0.1.75;received=1.2.3.4`, false, "224.0.1.75:5060"},
+	} {
+		var via Via
+		err := via.Parse(c.via)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr := responseAddr(&via, c.reliable); addr != c.addr {
+			t.Fatal(c.via, addr)
+		}
+	}
+}
+
+func Test_ResolveTarget(t *testing.T) {
+	for _, c := range []struct {
+		uri       string
+		transport string
+		addr      string
+	}{
+		{`sip:bob@biloxi.com`, TransportUDP, "biloxi.com:5060"},
+		{`sip:bob@biloxi.com:5070;transport=TCP`, TransportTCP, "biloxi.com:5070"},
+		{`sips:bob@biloxi.com;transport=tcp`, TransportTLS, "biloxi.com:5061"},
+		{`sip:bob@[2001:db8::10];maddr=239.255.255.1`, TransportUDP, "239.255.255.1:5060"},
+	} {
+		var uri URI
+		err := uri.Parse(c.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport, addr, err := ResolveTarget(&uri)
+		if err != nil || transport != c.transport || addr != c.addr {
+			t.Fatal(c.uri, transport, addr, err)
+		}
+	}
+	var uri URI
+	uri.Parse(`tel:+86-10-12345678`)
+	if _, _, err := ResolveTarget(&uri); err == nil {
+		t.FailNow()
+	}
+}
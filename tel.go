@@ -0,0 +1,177 @@
+package sip
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	errTelURIFormat         = errors.New("error tel uri format")
+	errTelURIMissingContext = errors.New("local tel uri missing phone-context")
+	errTelURIInvalidNumber  = errors.New("error tel uri number")
+	errTelURINeedHost       = errors.New("tel uri needs a host to convert")
+	errNotTelURI            = errors.New("uri is not tel")
+)
+
+// TelURI 表示 tel:+86-10-12345678;ext=1 ，RFC 3966 。
+// 全局号码以 + 开头，本地号码必须有 phone-context 参数。
+type TelURI struct {
+	// 号码，包含 + 和视觉分隔符 -.()
+	Number string
+	// 参数，按照顺序，包括 phone-context
+	Params         []KV
+	OriginalString string `json:"-"`
+}
+
+// Reset 重置数据
+func (t *TelURI) Reset() {
+	t.Number = ""
+	t.Params = nil
+	t.OriginalString = ""
+}
+
+// Parse 从 line 解析数据。
+func (t *TelURI) Parse(line string) error {
+	t.Reset()
+	t.OriginalString = line
+	line = TrimByte(strings.TrimSpace(line), '<', '>')
+	// tel:
+	i := strings.IndexByte(line, ':')
+	if i < 0 || !strings.EqualFold(line[:i], "tel") {
+		return errTelURIFormat
+	}
+	line = line[i+1:]
+	// number;params
+	i = strings.IndexByte(line, ';')
+	if i >= 0 {
+		err := parseURIKVs(&t.Params, line[i+1:], ";")
+		if err != nil {
+			return errTelURIFormat
+		}
+		line = line[:i]
+	}
+	t.Number = line
+	if !t.IsGlobal() {
+		if _, ok := t.Param("phone-context"); !ok {
+			return errTelURIMissingContext
+		}
+	}
+	if !isTelNumber(t.Number) {
+		return errTelURIInvalidNumber
+	}
+	return nil
+}
+
+// isTelNumber 检查号码，全局号码是 + 和数字，本地号码是 16 进制数字和 *# ，都可以有视觉分隔符
+func isTelNumber(number string) bool {
+	global := strings.HasPrefix(number, "+")
+	if global {
+		number = number[1:]
+	}
+	n := 0
+	for i := 0; i < len(number); i++ {
+		c := number[i]
+		switch {
+		case c >= '0' && c <= '9':
+			n++
+		case strings.IndexByte("-.()", c) >= 0:
+		case !global && (strings.IndexByte("*#", c) >= 0 ||
+			(c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')):
+			n++
+		default:
+			return false
+		}
+	}
+	return n > 0
+}
+
+// IsGlobal 返回是否全局号码
+func (t *TelURI) IsGlobal() bool {
+	return strings.HasPrefix(t.Number, "+")
+}
+
+// Param 返回参数 key 的值，key 不区分大小写，第二个返回值表示是否存在
+func (t *TelURI) Param(key string) (string, bool) {
+	for i := 0; i < len(t.Params); i++ {
+		if strings.EqualFold(t.Params[i].Key, key) {
+			return t.Params[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// PhoneContext 返回 phone-context 参数
+func (t *TelURI) PhoneContext() string {
+	v, _ := t.Param("phone-context")
+	return v
+}
+
+// Digits 返回去掉视觉分隔符的号码，用于比较
+func (t *TelURI) Digits() string {
+	var str strings.Builder
+	for i := 0; i < len(t.Number); i++ {
+		if strings.IndexByte("-.()", t.Number[i]) < 0 {
+			str.WriteByte(t.Number[i])
+		}
+	}
+	return str.String()
+}
+
+// FormatTo 格式化到 writer 中，不包含 <>
+func (t *TelURI) FormatTo(writer Writer) error {
+	_, err := writer.WriteString("tel:")
+	if err != nil {
+		return err
+	}
+	_, err = writer.WriteString(t.user())
+	return err
+}
+
+// String 返回格式化后的字符串，不包含 <>
+func (t *TelURI) String() string {
+	var str strings.Builder
+	t.FormatTo(&str)
+	return str.String()
+}
+
+// user 返回 number;params
+func (t *TelURI) user() string {
+	var str strings.Builder
+	str.WriteString(t.Number)
+	for i := 0; i < len(t.Params); i++ {
+		str.WriteByte(';')
+		str.WriteString(escapeURI(t.Params[i].Key, uriParamUnreserved))
+		if t.Params[i].Value != "" {
+			str.WriteByte('=')
+			str.WriteString(escapeURI(t.Params[i].Value, uriParamUnreserved))
+		}
+	}
+	return str.String()
+}
+
+// SIPURI 转换为 sip:number;params@host;user=phone ，RFC 3261 19.1.6 。
+// host 为空时，全局号码没有 host 不能转换，本地号码使用 phone-context 的域名
+func (t *TelURI) SIPURI(host string) (URI, error) {
+	var u URI
+	if host == "" {
+		ctx := t.PhoneContext()
+		if ctx == "" || strings.HasPrefix(ctx, "+") {
+			return u, errTelURINeedHost
+		}
+		host = ctx
+	}
+	u.Scheme = "sip"
+	u.Name = t.user()
+	u.Address = host
+	u.Params = append(u.Params, KV{Key: "user", Value: "phone"})
+	return u, nil
+}
+
+// TelURI 返回 tel 的 u 的 TelURI
+func (u *URI) TelURI() (TelURI, error) {
+	var t TelURI
+	if u.Scheme != "tel" {
+		return t, errNotTelURI
+	}
+	return t, t.Parse(u.String())
+}
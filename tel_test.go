@@ -0,0 +1,62 @@
+package sip
+
+import "testing"
+
+func Test_TelURI(t *testing.T) {
+	var tel TelURI
+	err := tel.Parse(`tel:+86-10-(1234)5678;ext=101`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tel.IsGlobal() || tel.Digits() != "+861012345678" || tel.Params[0].Value != "101" {
+		t.FailNow()
+	}
+	u, err := tel.SIPURI("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "sip:+86-10-(1234)5678;ext=101@example.com;user=phone" {
+		t.Fatal(u.String())
+	}
+	// 本地号码
+	err = tel.Parse(`tel:7042;phone-context=example.com`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tel.IsGlobal() || tel.PhoneContext() != "example.com" {
+		t.FailNow()
+	}
+	u, err = tel.SIPURI("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "sip:7042;phone-context=example.com@example.com;user=phone" {
+		t.Fatal(u.String())
+	}
+	// URI
+	err = u.Parse(`<tel:+8613800000000>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "+8613800000000" || u.Address != "" || u.String() != "tel:+8613800000000" {
+		t.FailNow()
+	}
+	tel, err = u.TelURI()
+	if err != nil || tel.Number != "+8613800000000" {
+		t.FailNow()
+	}
+}
+
+func Test_TelURI_Error(t *testing.T) {
+	var tel TelURI
+	for _, s := range []string{
+		"sip:+8613800000000",
+		"tel:7042",
+		"tel:+86abc",
+		"tel:+",
+	} {
+		if err := tel.Parse(s); err == nil {
+			t.Fatal(s)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package sip
+
+import "time"
+
+// Timer 表示 RFC 3261 的 T1 T2 T4 ，事务的定时器都根据它们计算，除了 Timer C
+type Timer struct {
+	// RTT 的估计值，默认是 DefaultT1
+	T1 time.Duration
+	// 非 INVITE 请求和 INVITE 响应的最大重发间隔，默认是 DefaultT2
+	T2 time.Duration
+	// 消息在网络中存留的最长时间，默认是 DefaultT4
+	T4 time.Duration
+	// INVITE 服务端事务等待 Handler 发送最终响应的时间，默认是 DefaultTimerC
+	C time.Duration
+}
+
+// init 纠正数据，小于 1 的使用默认值
+func (t *Timer) init() {
+	if t.T1 < 1 {
+		t.T1 = DefaultT1
+	}
+	if t.T2 < 1 {
+		t.T2 = DefaultT2
+	}
+	if t.T2 < t.T1 {
+		t.T2 = t.T1
+	}
+	if t.T4 < 1 {
+		t.T4 = DefaultT4
+	}
+	if t.C < 1 {
+		t.C = DefaultTimerC
+	}
+}
+
+// timeout 返回 64*T1 ，也就是 Timer B F H J
+func (t *Timer) timeout() time.Duration {
+	return 64 * t.T1
+}
+
+// timerD 返回 Timer D ，至少是 DefaultTimerD
+func (t *Timer) timerD() time.Duration {
+	if d := t.timeout(); d > DefaultTimerD {
+		return d
+	}
+	return DefaultTimerD
+}
+
+// transactionTimeout 返回没有指定超时的事务的超时。
+// 非 INVITE 由 Timer F 结束，返回 0 ；INVITE 收到 1xx 后 Timer B 停止，
+// 使用 Timer C ，至少是 Timer B
+func (t *Timer) transactionTimeout(method string) time.Duration {
+	if method != MethodInvite {
+		return 0
+	}
+	if d := t.timeout(); d > t.C {
+		return d
+	}
+	return t.C
+}
+
+// nextRTO 返回 rto 翻倍后的值，最大是 T2 ，也就是 Timer E G
+func (t *Timer) nextRTO(rto time.Duration) time.Duration {
+	rto *= 2
+	if rto > t.T2 {
+		rto = t.T2
+	}
+	return rto
+}
+
+// SetTargetTimer 设置发往 addr 的事务使用的 timer ，覆盖 Server.Timer 。
+// addr 可以是 ip:port ，也可以是 ip 表示这个 ip 的所有端口。
+func (s *Server) SetTargetTimer(addr string, timer Timer) {
+	timer.init()
+	s.timerLock.Lock()
+	if s.targetTimer == nil {
+		s.targetTimer = make(map[string]Timer)
+	}
+	s.targetTimer[addr] = timer
+	s.timerLock.Unlock()
+}
+
+// DeleteTargetTimer 移除 SetTargetTimer 设置的 addr 的 timer
+func (s *Server) DeleteTargetTimer(addr string) {
+	s.timerLock.Lock()
+	delete(s.targetTimer, addr)
+	s.timerLock.Unlock()
+}
+
+// getTimer 返回 conn 的对方地址使用的 timer
+func (s *Server) getTimer(conn Conn) Timer {
+	s.timerLock.RLock()
+	defer s.timerLock.RUnlock()
+	if len(s.targetTimer) > 0 {
+		// ip:port
+		if t, ok := s.targetTimer[conn.RemoteAddrString()]; ok {
+			return t
+		}
+		// ip
+		if t, ok := s.targetTimer[conn.RemoteIP()]; ok {
+			return t
+		}
+	}
+	return s.Timer
+}
@@ -0,0 +1,71 @@
+package sip
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Server_TargetTimer(t *testing.T) {
+	s := newTestServer(new(testHandler))
+	defer s.closeTest()
+	conn := newTestConn(true)
+	// 默认
+	if timer := s.getTimer(conn); timer != s.Timer {
+		t.Fatalf("timer %v, want %v", timer, s.Timer)
+	}
+	// ip ，没有设置的使用默认值
+	s.SetTargetTimer("127.0.0.1", Timer{T1: time.Second})
+	timer := s.getTimer(conn)
+	if timer.T1 != time.Second || timer.T2 != DefaultT2 || timer.T4 != DefaultT4 || timer.C != DefaultTimerC {
+		t.Fatalf("ip timer %v", timer)
+	}
+	// ip:port 优先
+	s.SetTargetTimer("127.0.0.1:5070", testTimer)
+	if timer := s.getTimer(conn); timer != testTimer {
+		t.Fatalf("ip:port timer %v, want %v", timer, testTimer)
+	}
+	// 移除
+	s.DeleteTargetTimer("127.0.0.1:5070")
+	if timer := s.getTimer(conn); timer.T1 != time.Second {
+		t.Fatalf("timer %v after delete ip:port", timer)
+	}
+	s.DeleteTargetTimer("127.0.0.1")
+	if timer := s.getTimer(conn); timer != s.Timer {
+		t.Fatalf("timer %v after delete ip, want %v", timer, s.Timer)
+	}
+}
+
+func Test_Timer_TransactionTimeout(t *testing.T) {
+	timer := testTimer
+	if d := timer.transactionTimeout(MethodMessage); d != 0 {
+		t.Fatalf("non-INVITE timeout %v, want 0", d)
+	}
+	// Timer B 大于 Timer C
+	if d := timer.transactionTimeout(MethodInvite); d != timer.timeout() {
+		t.Fatalf("INVITE timeout %v, want %v", d, timer.timeout())
+	}
+	timer.C = time.Second
+	if d := timer.transactionTimeout(MethodInvite); d != timer.C {
+		t.Fatalf("INVITE timeout %v, want %v", d, timer.C)
+	}
+}
+
+func Test_Server_SendRequestWithConnTimeout(t *testing.T) {
+	h := new(testHandler)
+	s := newTestServer(h)
+	defer s.closeTest()
+	// WriteTimeout 小于 Timer F ，不影响事务
+	s.WriteTimeout = 100 * time.Millisecond
+	conn := newTestConn(true)
+	err := s.SendRequestWithConnTimeout(conn, newTestClientRequest(s, MethodMessage), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := conn.collect(testTimer.timeout() + 100*time.Millisecond)
+	if n := len(ws); n < 2 || ws[n-1].time.Sub(ws[0].time) < s.WriteTimeout {
+		t.Fatalf("retransmissions stopped early, %d requests", n)
+	}
+	if _, _, errs := h.result(); len(errs) != 1 || errs[0] != ErrTransactionTimeout {
+		t.Fatalf("errors %v, want [%v]", errs, ErrTransactionTimeout)
+	}
+}
@@ -2,14 +2,117 @@ package sip
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 var (
-	errTXTimeout = errors.New("transaction timeout")
-	errTXFinish  = errors.New("transaction finished")
+	errTXFinish = errors.New("transaction finished")
+)
+
+var (
+	// ErrTransactionTimeout 表示事务超时，没有收到最终响应，相当于 408
+	ErrTransactionTimeout = errors.New("transaction timeout")
+	// ErrTransportFailure 表示发送消息失败，相当于 503
+	ErrTransportFailure = errors.New("transport failure")
+	// ErrTransactionCanceled 表示事务被取消，ctx 结束或者服务关闭，相当于 487
+	ErrTransactionCanceled = errors.New("transaction canceled")
+	// ErrACKTimeout 表示发送 INVITE 的 2xx 响应后，64*T1 内没有收到 ACK ，
+	// 应该结束会话，RFC 3261 13.3.1.4
+	ErrACKTimeout = errors.New("ack timeout")
+	// ErrTransactionExists 表示发送请求时，相同 key 的事务已经存在
+	ErrTransactionExists = errors.New("transaction exists")
+)
+
+// ErrorHandler 是 Handler 的可选接口，实现了它就可以收到主动发起的事务失败的通知，
+// 比如把设备标记为离线，以及 ErrACKTimeout 的通知。
+// 没有实现时，超时会回调一个本地生成的 408 响应。
+type ErrorHandler interface {
+	// 在事务协程中调用，不要阻塞
+	HandleError(*TransactionError)
+}
+
+// TransactionError 表示事务失败的错误
+type TransactionError struct {
+	// 事务的 key
+	Key string
+	// 失败的原因，ErrTransactionTimeout ，ErrTransportFailure ，ErrTransactionCanceled ，
+	// ErrTransactionExists
+	Err error
+	// 底层的错误，比如 io 错误或者 ctx 的错误，可能为 nil
+	Cause error
+	// 请求消息，不要修改
+	Request *Message
+	// 发送请求的连接
+	Conn Conn
+}
+
+// Status 返回 Err 对应的状态码，超时是 408 ，传输错误是 503 ，取消是 487
+func (e *TransactionError) Status() string {
+	switch e.Err {
+	case ErrTransactionTimeout:
+		return StatusRequestTimeout
+	case ErrTransportFailure:
+		return StatusServiceUnavailable
+	case ErrTransactionCanceled:
+		return StatusRequetTerminated
+	}
+	return ""
+}
+
+func (e *TransactionError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("transaction %s: %v: %v", e.Key, e.Err, e.Cause)
+	}
+	return fmt.Sprintf("transaction %s: %v", e.Key, e.Err)
+}
+
+// Unwrap 返回 Err ，方便使用 errors.Is
+func (e *TransactionError) Unwrap() error {
+	return e.Err
+}
+
+// 事务的状态，RFC 3261 17
+const (
+	txStateCalling int32 = iota
+	txStateTrying
+	txStateProceeding
+	txStateCompleted
+	txStateConfirmed
+	txStateTerminated
+	// INVITE 发送或者收到了 2xx ，处理 2xx 和 ACK 的重发，RFC 6026
+	txStateAccepted
 )
 
 type transaction interface {
 	writeMessage(Conn, *Message) error
 	Key() string
 }
+
+// txTimer 封装 time.Timer ，停止后 C 为 nil ，在 select 中不会触发
+type txTimer struct {
+	t *time.Timer
+	C <-chan time.Time
+}
+
+// Start 启动计时器，d 之后触发
+func (t *txTimer) Start(d time.Duration) {
+	t.Stop()
+	if t.t == nil {
+		t.t = time.NewTimer(d)
+	} else {
+		t.t.Reset(d)
+	}
+	t.C = t.t.C
+}
+
+// Stop 停止计时器
+func (t *txTimer) Stop() {
+	if t.t != nil && !t.t.Stop() {
+		select {
+		case <-t.t.C:
+		default:
+		}
+	}
+	t.C = nil
+}
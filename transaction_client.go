@@ -0,0 +1,681 @@
+package sip
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/qq51529210/log"
+)
+
+const (
+	// 客户端事务的响应消息队列长度
+	clientTransactionResponseQueueLen = 8
+)
+
+// clientTransactions 表示客户端事务表
+type clientTransactions struct {
+	sync.RWMutex
+	t map[string]*clientTransaction
+	// INVITE 事务，用于匹配调用者发送的 2xx 的 ACK ，它的 branch 和 INVITE 不一样
+	ack map[string]*clientTransaction
+}
+
+// init 初始化
+func (t *clientTransactions) init() {
+	t.t = make(map[string]*clientTransaction)
+	t.ack = make(map[string]*clientTransaction)
+}
+
+// add 添加 tt ，如果已经存在相同 key 的事务，返回 false
+func (t *clientTransactions) add(tt *clientTransaction) bool {
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.t[tt.key]; ok {
+		return false
+	}
+	t.t[tt.key] = tt
+	if tt.method == MethodInvite {
+		t.ack[ackKey(tt.req)] = tt
+	}
+	return true
+}
+
+// get 根据 key 返回 tx ，处理响应消息时使用
+func (t *clientTransactions) get(key string) *clientTransaction {
+	t.RLock()
+	tt := t.t[key]
+	t.RUnlock()
+	//
+	return tt
+}
+
+// getACK 返回 2xx 的 ACK 对应的 INVITE 事务
+func (t *clientTransactions) getACK(msg *Message) *clientTransaction {
+	t.RLock()
+	tt := t.ack[ackKey(msg)]
+	t.RUnlock()
+	//
+	return tt
+}
+
+// rm 移除 tt
+func (t *clientTransactions) rm(tt *clientTransaction) {
+	// 移除
+	t.Lock()
+	if t.t[tt.key] == tt {
+		delete(t.t, tt.key)
+	}
+	if tt.method == MethodInvite {
+		key := ackKey(tt.req)
+		if t.ack[key] == tt {
+			delete(t.ack, key)
+		}
+	}
+	t.Unlock()
+	// 通知
+	tt.quit.Close()
+}
+
+// clientTransaction 表示一个主动发起请求的客户端事务
+type clientTransaction struct {
+	// 事务表的 key
+	key string
+	// 请求方法，区分 INVITE 和非 INVITE 事务
+	method string
+	// 发送请求的连接
+	conn Conn
+	// 定时器
+	timer Timer
+	// 调用者上下文数据
+	ctx context.Context
+	// 请求消息的拷贝，用于生成 ACK
+	req *Message
+	// 请求消息数据，用于重发
+	reqData bytes.Buffer
+	// ACK 消息数据，用于回应重发的最终响应
+	ackData bytes.Buffer
+	// 调用者发送的 2xx 的 ACK 消息数据，key 是 To 的 tag ，用于回应重发的 2xx ，使用锁保护
+	ackLock sync.Mutex
+	acks    map[string][]byte
+	// accepted 状态已经回调的 2xx 的 To 的 tag ，用于过滤重发的
+	accepted []string
+	// 状态，只在事务协程中访问
+	state int32
+	// 收到的响应消息
+	resC chan *Message
+	// 退出信号
+	quit safeChan[struct{}]
+	// 同步调用的结果，为 nil 则回调 Handler.HandleResponse
+	call *clientCall
+	// 已经回调的 1xx ，用于过滤重发的
+	provisional []string
+	// CANCEL 信号，只有 INVITE 使用
+	cancelC chan struct{}
+	// 是否需要在收到 1xx 后发送 CANCEL
+	cancelPending bool
+	// 是否已经发送 CANCEL
+	canceled bool
+}
+
+// clientCall 用于同步等待事务的最终响应
+type clientCall struct {
+	// 1xx 的回调
+	provisional func(*Message)
+	// 最终响应
+	res *Message
+	// 错误
+	err error
+	// 结果通知
+	done chan struct{}
+}
+
+// finish 设置结果并通知，只在事务协程中调用
+func (c *clientCall) finish(res *Message, err error) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	c.res = res
+	c.err = err
+	close(c.done)
+	return true
+}
+
+func (t *clientTransaction) Key() string {
+	return t.key
+}
+
+// writeMessage 格式化 msg 并使用 conn 发送
+func (t *clientTransaction) writeMessage(conn Conn, msg *Message) error {
+	var buf bytes.Buffer
+	msg.FormatTo(&buf)
+	log.DebugfTrace(t.key, "write %s %s:%s\n%s", conn.Network(), conn.RemoteIP(), conn.RemotePort(), buf.String())
+	return conn.write(buf.Bytes())
+}
+
+// putResponse 把响应消息交给事务协程处理，返回 false 表示事务已经结束或者队列已满
+func (t *clientTransaction) putResponse(msg *Message) bool {
+	select {
+	case <-t.quit.c:
+		return false
+	default:
+	}
+	select {
+	case t.resC <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// newClientTransaction 创建客户端事务，并发送 msg
+func (s *Server) newClientTransaction(ctx context.Context, conn Conn, msg *Message) (*clientTransaction, error) {
+	// ACK 和 CANCEL 需要第一个 Via
+	if len(msg.Header.Via) < 1 {
+		return nil, errMissingHeaderVia
+	}
+	// 传输协议和 conn 一致
+	setViaTransport(&msg.Header.Via[0], conn)
+	// 对方看到的公网地址
+	s.setPublicAddr(conn, msg)
+	t := &clientTransaction{
+		key:    msg.clientTransactionKey(),
+		method: msg.Header.CSeq.Method,
+		conn:   conn,
+		timer:  s.getTimer(conn),
+		ctx:    ctx,
+		resC:   make(chan *Message, clientTransactionResponseQueueLen),
+	}
+	if t.method == MethodInvite {
+		t.cancelC = make(chan struct{}, 1)
+	}
+	t.quit.Init(0)
+	// 拷贝请求
+	t.req = new(Message)
+	msg.CopyTo(t.req)
+	// 添加
+	if !s.clienttx.add(t) {
+		return nil, ErrTransactionExists
+	}
+	// 发送
+	msg.FormatTo(&t.reqData)
+	log.DebugfTrace(t.key, "write %s %s:%s\n%s", conn.Network(), conn.RemoteIP(), conn.RemotePort(), t.reqData.String())
+	err := conn.write(t.reqData.Bytes())
+	if err != nil {
+		s.clienttx.rm(t)
+		return nil, err
+	}
+	return t, nil
+}
+
+// setViaTransport 根据发送的 conn 设置 via 的传输协议，RFC 3261 18.1.1 。
+// tcp 连接保留 WithTransport 指定的 TLS 等
+func setViaTransport(via *Via, conn Conn) {
+	if conn.isUDP() {
+		via.Proto = "UDP"
+		return
+	}
+	if via.Proto == "" || via.Proto == "UDP" {
+		via.Proto = "TCP"
+	}
+}
+
+// startClientTransaction 启动事务协程
+func (s *Server) startClientTransaction(t *clientTransaction, cancel context.CancelFunc) {
+	s.wg.Add(1)
+	if t.method == MethodInvite {
+		go s.inviteClientTransactionRoutine(t, cancel)
+	} else {
+		go s.nonInviteClientTransactionRoutine(t, cancel)
+	}
+}
+
+// finishClientTransaction 结束事务
+func (s *Server) finishClientTransaction(t *clientTransaction, cancel context.CancelFunc) {
+	// 移除
+	s.clienttx.rm(t)
+	// 回收没有处理的响应
+	for {
+		select {
+		case msg := <-t.resC:
+			s.msgPool.Put(msg)
+		default:
+			// 同步调用，确保已经通知
+			if t.call != nil {
+				t.call.finish(nil, &TransactionError{Key: t.key, Err: errTXFinish, Request: t.req, Conn: t.conn})
+			}
+			if cancel != nil {
+				cancel()
+			}
+			// 协程结束
+			s.wg.Done()
+			return
+		}
+	}
+}
+
+// isNewProvisional 返回 1xx 是否没有回调过，
+// 使用状态码、To 的 tag 和 RSeq 区分
+func (t *clientTransaction) isNewProvisional(msg *Message) bool {
+	key := msg.StartLine[1] + " " + msg.Header.To.Tag + " " + msg.Header.GetOther("RSeq", 0)
+	for _, k := range t.provisional {
+		if k == key {
+			return false
+		}
+	}
+	t.provisional = append(t.provisional, key)
+	return true
+}
+
+// handleClientTransactionResponse 按顺序回调处理响应消息，重发的 1xx 不回调
+func (s *Server) handleClientTransactionResponse(t *clientTransaction, msg *Message) {
+	if msg.statusClass() == '1' && !t.isNewProvisional(msg) {
+		s.msgPool.Put(msg)
+		return
+	}
+	// 同步调用
+	if t.call != nil {
+		if msg.statusClass() == '1' {
+			if t.call.provisional != nil {
+				t.call.provisional(msg)
+			}
+			s.msgPool.Put(msg)
+			return
+		}
+		// 目标刷新
+		s.refreshDialogTarget(t, msg)
+		// 最终响应交给调用者
+		if !t.call.finish(msg, nil) {
+			s.msgPool.Put(msg)
+		}
+		return
+	}
+	// 目标刷新
+	if msg.statusClass() == '2' {
+		s.refreshDialogTarget(t, msg)
+	}
+	s.Handler.HandleResponse(&Response{transaction: t, Conn: t.conn, Message: msg, s: s, Context: t.ctx})
+	// 回收
+	s.msgPool.Put(msg)
+}
+
+// refreshDialogTarget 使用对话内的 re-INVITE 或 UPDATE 的 2xx 响应 msg 更新对话的 RemoteTarget
+func (s *Server) refreshDialogTarget(t *clientTransaction, msg *Message) {
+	if msg.statusClass() != '2' || (t.method != MethodInvite && t.method != MethodUpdate) {
+		return
+	}
+	if d := s.MatchDialog(msg); d != nil {
+		d.refreshTarget(msg)
+	}
+}
+
+// clientTransactionFailed 在事务失败时调用，err 是原因，cause 是底层的错误
+func (s *Server) clientTransactionFailed(t *clientTransaction, err, cause error) {
+	t.state = txStateTerminated
+	e := &TransactionError{Key: t.key, Err: err, Cause: cause, Request: t.req, Conn: t.conn}
+	// 同步调用
+	if t.call != nil {
+		t.call.finish(nil, e)
+		return
+	}
+	log.ErrorTrace(t.key, e)
+	// 通知
+	if h, ok := s.Handler.(ErrorHandler); ok {
+		h.HandleError(e)
+		return
+	}
+	// 超时，生成一个本地的 408 响应通知调用者，RFC 3261 8.1.3.1
+	if err == ErrTransactionTimeout {
+		msg := s.newLocalResponse(t.req, StatusRequestTimeout)
+		s.Handler.HandleResponse(&Response{transaction: t, Conn: t.conn, Message: msg, s: s, Context: t.ctx})
+		s.msgPool.Put(msg)
+	}
+}
+
+// clientTransactionDone 在 ctx 结束时调用，超时当作事务超时，否则是取消
+func (s *Server) clientTransactionDone(t *clientTransaction) {
+	err := t.ctx.Err()
+	if err == context.DeadlineExceeded {
+		s.clientTransactionFailed(t, ErrTransactionTimeout, err)
+		return
+	}
+	s.clientTransactionFailed(t, ErrTransactionCanceled, err)
+}
+
+// writeClientTransactionACK 发送非 2xx 最终响应的 ACK ，RFC 3261 17.1.1.3
+func (s *Server) writeClientTransactionACK(t *clientTransaction, res *Message) error {
+	if t.ackData.Len() < 1 {
+		ack := newACK(t.req, res)
+		ack.FormatTo(&t.ackData)
+		log.DebugfTrace(t.key, "write %s %s:%s\n%s", t.conn.Network(), t.conn.RemoteIP(), t.conn.RemotePort(), t.ackData.String())
+	}
+	return t.conn.write(t.ackData.Bytes())
+}
+
+// inviteClientTransactionRoutine 运行 INVITE 客户端事务的状态机，RFC 3261 17.1.1 。
+// ctx 结束时，事务也结束
+func (s *Server) inviteClientTransactionRoutine(t *clientTransaction, cancel context.CancelFunc) {
+	// 计时器
+	var timerA, timerB, timerD, timerL txTimer
+	// 退出清理
+	defer func() {
+		timerA.Stop()
+		timerB.Stop()
+		timerD.Stop()
+		timerL.Stop()
+		s.finishClientTransaction(t, cancel)
+	}()
+	// calling
+	t.state = txStateCalling
+	rto := t.timer.T1
+	if t.conn.isUDP() {
+		timerA.Start(rto)
+	}
+	timerB.Start(t.timer.timeout())
+	// accepted 之后不再使用
+	done := t.ctx.Done()
+	for {
+		select {
+		case <-s.quit.c:
+			if t.state != txStateAccepted {
+				s.clientTransactionFailed(t, ErrTransactionCanceled, errServerClosed)
+			}
+			return
+		case <-done:
+			s.clientTransactionDone(t)
+			return
+		case <-timerA.C:
+			// 重发，间隔翻倍
+			err := t.conn.write(t.reqData.Bytes())
+			if err != nil {
+				s.clientTransactionFailed(t, ErrTransportFailure, err)
+				return
+			}
+			log.DebugTrace(t.key, "retransmission")
+			rto *= 2
+			timerA.Start(rto)
+		case <-timerB.C:
+			s.clientTransactionFailed(t, ErrTransactionTimeout, nil)
+			return
+		case <-timerD.C:
+			return
+		case <-timerL.C:
+			return
+		case <-t.cancelC:
+			switch t.state {
+			case txStateCalling:
+				// 收到 1xx 后再发送
+				t.cancelPending = true
+			case txStateProceeding:
+				s.sendClientTransactionCancel(t)
+				timerB.Start(t.timer.timeout())
+			}
+		case msg := <-t.resC:
+			// 已经 completed ，只回应重发的最终响应
+			if t.state == txStateCompleted {
+				if msg.statusClass() != '1' {
+					err := s.writeClientTransactionACK(t, msg)
+					if err != nil {
+						log.ErrorTrace(t.key, err)
+					}
+				}
+				s.msgPool.Put(msg)
+				continue
+			}
+			// 已经 accepted ，只处理 2xx
+			if t.state == txStateAccepted {
+				if msg.statusClass() == '2' {
+					s.handleClientTransaction2xx(t, msg)
+				} else {
+					s.msgPool.Put(msg)
+				}
+				continue
+			}
+			switch msg.statusClass() {
+			case '1':
+				// proceeding ，停止重发
+				t.state = txStateProceeding
+				timerA.Stop()
+				if !t.canceled {
+					timerB.Stop()
+				}
+				s.handleClientTransactionResponse(t, msg)
+				// 发送等待中的 CANCEL ，64*T1 内没有收到最终响应，事务结束，RFC 3261 9.1
+				if t.cancelPending {
+					t.cancelPending = false
+					s.sendClientTransactionCancel(t)
+					timerB.Start(t.timer.timeout())
+				}
+			case '2':
+				// 2xx 的 ACK 由调用者发送，64*T1 内继续处理重发和分叉的 2xx ，RFC 6026 7.2
+				t.state = txStateAccepted
+				t.accepted = append(t.accepted, msg.Header.To.Tag)
+				timerA.Stop()
+				timerB.Stop()
+				done = nil
+				s.handleClientTransactionResponse(t, msg)
+				timerL.Start(t.timer.timeout())
+			default:
+				// 300-699 ，发送 ACK
+				err := s.writeClientTransactionACK(t, msg)
+				if err != nil {
+					log.ErrorTrace(t.key, err)
+				}
+				t.state = txStateCompleted
+				timerA.Stop()
+				timerB.Stop()
+				s.handleClientTransactionResponse(t, msg)
+				// 可靠传输 Timer D 为 0
+				if !t.conn.isUDP() {
+					return
+				}
+				timerD.Start(t.timer.timerD())
+			}
+		}
+	}
+}
+
+// sendClientTransactionCancel 为 INVITE 事务 t 发起 CANCEL 事务，
+// CANCEL 的响应不会回调 Handler
+func (s *Server) sendClientTransactionCancel(t *clientTransaction) {
+	if t.canceled {
+		return
+	}
+	t.canceled = true
+	ct, err := s.newClientTransaction(context.Background(), t.conn, newCancel(t.req))
+	if err != nil {
+		log.ErrorTrace(t.key, err)
+		return
+	}
+	// 结果没有人等待
+	ct.call = &clientCall{done: make(chan struct{})}
+	s.startClientTransaction(ct, nil)
+}
+
+// Cancel 取消主动发起的 INVITE 事务，msg 是 SendRequest 或者 Do 发送的 INVITE 。
+// 收到 1xx 之后才会发送 CANCEL ，收到最终响应（通常是 487）后，事务按正常的流程结束，RFC 3261 9.1 。
+func (s *Server) Cancel(msg *Message) error {
+	if msg.Header.CSeq.Method != MethodInvite {
+		return errCancelNotInvite
+	}
+	t := s.clienttx.get(msg.clientTransactionKey())
+	if t == nil {
+		return errTransactionNotExists
+	}
+	select {
+	case t.cancelC <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// nonInviteClientTransactionRoutine 运行非 INVITE 客户端事务的状态机，RFC 3261 17.1.2 。
+// ctx 结束时，事务也结束
+func (s *Server) nonInviteClientTransactionRoutine(t *clientTransaction, cancel context.CancelFunc) {
+	// 计时器
+	var timerE, timerF, timerK txTimer
+	// 退出清理
+	defer func() {
+		timerE.Stop()
+		timerF.Stop()
+		timerK.Stop()
+		s.finishClientTransaction(t, cancel)
+	}()
+	// trying
+	t.state = txStateTrying
+	rto := t.timer.T1
+	if t.conn.isUDP() {
+		timerE.Start(rto)
+	}
+	timerF.Start(t.timer.timeout())
+	for {
+		select {
+		case <-s.quit.c:
+			s.clientTransactionFailed(t, ErrTransactionCanceled, errServerClosed)
+			return
+		case <-t.ctx.Done():
+			s.clientTransactionDone(t)
+			return
+		case <-timerE.C:
+			// 重发
+			err := t.conn.write(t.reqData.Bytes())
+			if err != nil {
+				s.clientTransactionFailed(t, ErrTransportFailure, err)
+				return
+			}
+			log.DebugTrace(t.key, "retransmission")
+			// trying 翻倍，最大 T2 ；proceeding 固定 T2
+			if t.state == txStateTrying {
+				rto = t.timer.nextRTO(rto)
+			} else {
+				rto = t.timer.T2
+			}
+			timerE.Start(rto)
+		case <-timerF.C:
+			s.clientTransactionFailed(t, ErrTransactionTimeout, nil)
+			return
+		case <-timerK.C:
+			return
+		case msg := <-t.resC:
+			// 已经 completed ，吸收重发的响应
+			if t.state == txStateCompleted {
+				s.msgPool.Put(msg)
+				continue
+			}
+			if msg.statusClass() == '1' {
+				t.state = txStateProceeding
+				s.handleClientTransactionResponse(t, msg)
+				continue
+			}
+			// 200-699
+			t.state = txStateCompleted
+			timerE.Stop()
+			timerF.Stop()
+			s.handleClientTransactionResponse(t, msg)
+			// 可靠传输 Timer K 为 0
+			if !t.conn.isUDP() {
+				return
+			}
+			timerK.Start(t.timer.T4)
+		}
+	}
+}
+
+// newLocalResponse 根据 req 生成一个本地的响应消息，它不会被发送
+func (s *Server) newLocalResponse(req *Message, status string) *Message {
+	res := s.msgPool.Get().(*Message)
+	res.Reset()
+	res.initResponse(req, status, "")
+	return res
+}
+
+// newACK 根据 INVITE 请求 req 和它的非 2xx 最终响应 res 生成 ACK ，RFC 3261 17.1.1.3
+func newACK(req, res *Message) *Message {
+	ack := new(Message)
+	ack.isRequest = true
+	ack.InitStartLineOfRequest(MethodACK, req.RequestURI())
+	// 只有请求的第一个 Via
+	ack.Header.Via = append(ack.Header.Via, req.Header.Via[0])
+	req.Header.From.CopyTo(&ack.Header.From)
+	res.Header.To.CopyTo(&ack.Header.To)
+	ack.Header.CallID = req.Header.CallID
+	ack.Header.CSeq.SN = req.Header.CSeq.SN
+	ack.Header.CSeq.Method = MethodACK
+	ack.Header.MaxForwards.Set(70)
+	// Route
+	ack.Header.Route = copyAddresses(ack.Header.Route, req.Header.Route)
+	return ack
+}
+
+// newCancel 根据 INVITE 请求 req 生成 CANCEL ，RFC 3261 9.1
+func newCancel(req *Message) *Message {
+	m := new(Message)
+	m.isRequest = true
+	m.InitStartLineOfRequest(MethodCancel, req.RequestURI())
+	// 只有请求的第一个 Via ，branch 相同
+	m.Header.Via = append(m.Header.Via, req.Header.Via[0])
+	req.Header.From.CopyTo(&m.Header.From)
+	req.Header.To.CopyTo(&m.Header.To)
+	m.Header.CallID = req.Header.CallID
+	m.Header.CSeq.SN = req.Header.CSeq.SN
+	m.Header.CSeq.Method = MethodCancel
+	m.Header.MaxForwards.Set(70)
+	// Route
+	m.Header.Route = copyAddresses(m.Header.Route, req.Header.Route)
+	return m
+}
+
+// sendACK 发送 2xx 的 ACK ，它不是事务，只发送一次。
+// INVITE 事务还在 accepted 状态的，保存数据用于回应重发的 2xx
+func (s *Server) sendACK(conn Conn, msg *Message) error {
+	var buf bytes.Buffer
+	msg.FormatTo(&buf)
+	log.DebugfTrace(msg.Header.CallID, "write %s %s:%s\n%s", conn.Network(), conn.RemoteIP(), conn.RemotePort(), buf.String())
+	if t := s.clienttx.getACK(msg); t != nil {
+		t.setACK(msg.Header.To.Tag, buf.Bytes())
+	}
+	return conn.write(buf.Bytes())
+}
+
+// setACK 保存 To 的 tag 是 tag 的 2xx 的 ACK 数据
+func (t *clientTransaction) setACK(tag string, b []byte) {
+	t.ackLock.Lock()
+	if t.acks == nil {
+		t.acks = make(map[string][]byte)
+	}
+	t.acks[tag] = b
+	t.ackLock.Unlock()
+}
+
+// getACK 返回 To 的 tag 是 tag 的 2xx 的 ACK 数据
+func (t *clientTransaction) getACK(tag string) []byte {
+	t.ackLock.Lock()
+	defer t.ackLock.Unlock()
+	return t.acks[tag]
+}
+
+// handleClientTransaction2xx 处理 accepted 状态收到的 2xx ，RFC 6026 7.2 。
+// 已经发送了 ACK 的，重发 ACK ；新的（通常是分叉的）回调 Handler.HandleResponse ，
+// 由调用者发送 ACK ；回调过但是还没有 ACK 的，丢弃
+func (s *Server) handleClientTransaction2xx(t *clientTransaction, msg *Message) {
+	defer s.msgPool.Put(msg)
+	tag := msg.Header.To.Tag
+	if b := t.getACK(tag); b != nil {
+		err := t.conn.write(b)
+		if err != nil {
+			log.ErrorTrace(t.key, err)
+			return
+		}
+		log.DebugTrace(t.key, "retransmission ACK")
+		return
+	}
+	for _, k := range t.accepted {
+		if k == tag {
+			return
+		}
+	}
+	t.accepted = append(t.accepted, tag)
+	s.Handler.HandleResponse(&Response{transaction: t, Conn: t.conn, Message: msg, s: s, Context: t.ctx})
+}
@@ -0,0 +1,398 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_ClientTransaction_Invite(t *testing.T) {
+	h := &testHandler{}
+	s := newTestServer(testResponseHandler{h})
+	defer s.closeTest()
+	// Timer A 翻倍，不受 T2 限制，Timer B 之后回调本地的 408
+	conn := newTestConn(true)
+	req := newTestClientRequest(s, MethodInvite)
+	err := s.sendRequest(context.Background(), conn, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := conn.collect(s.Timer.timeout() + 50*time.Millisecond)
+	// 最后一次重发和 Timer B 只差 T1
+	if len(ws) < 6 || len(ws) > 7 {
+		t.Fatalf("%d requests", len(ws))
+	}
+	checkTestIntervals(t, ws, time.Hour)
+	if _, res, _ := h.result(); len(res) != 1 || res[0] != StatusRequestTimeout {
+		t.Fatal(res)
+	}
+	// 非 2xx 发送 ACK ，重发的最终响应再次 ACK ，udp 等待 Timer D
+	req = newTestClientRequest(s, MethodInvite)
+	err = s.sendRequest(context.Background(), conn, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = conn.next(time.Second)
+	res := newTestResponse(req, StatusBusyHere, "486")
+	s.handleMessage(conn, copyTestMessage(res))
+	if m := conn.next(time.Second); m == nil || m.RequestMethod() != MethodACK || m.Header.To.Tag != "486" {
+		t.FailNow()
+	}
+	s.handleMessage(conn, copyTestMessage(res))
+	if m := conn.next(time.Second); m == nil || m.RequestMethod() != MethodACK {
+		t.FailNow()
+	}
+	if s.clienttx.get(req.clientTransactionKey()) == nil {
+		t.FailNow()
+	}
+	// 可靠传输 Timer D 为 0
+	conn = newTestConn(false)
+	req = newTestClientRequest(s, MethodInvite)
+	err = s.sendRequest(context.Background(), conn, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = conn.next(time.Second)
+	s.handleMessage(conn, newTestResponse(req, StatusBusyHere, "486"))
+	if m := conn.next(time.Second); m == nil || m.RequestMethod() != MethodACK {
+		t.FailNow()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if s.clienttx.get(req.clientTransactionKey()) != nil {
+		t.FailNow()
+	}
+	// 2xx 之后 Timer L 内，分叉的 2xx 回调，已经 ACK 的 2xx 重发 ACK
+	req = newTestClientRequest(s, MethodInvite)
+	err = s.sendRequest(context.Background(), conn, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = conn.next(time.Second)
+	res = newTestResponse(req, StatusOK, "200")
+	s.handleMessage(conn, copyTestMessage(res))
+	time.Sleep(20 * time.Millisecond)
+	ack := s.NewRequest(MethodACK, req.RequestURI(), req.Header.From, res.Header.To)
+	ack.Header.CallID = req.Header.CallID
+	ack.Header.CSeq.SN = req.Header.CSeq.SN
+	err = s.sendRequest(context.Background(), conn, ack, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.next(time.Second)
+	s.handleMessage(conn, copyTestMessage(res))
+	if m := conn.next(time.Second); m == nil || m.RequestMethod() != MethodACK || m.Header.To.Tag != "200" {
+		t.FailNow()
+	}
+	s.handleMessage(conn, newTestResponse(req, StatusOK, "fork"))
+	time.Sleep(20 * time.Millisecond)
+	if _, res, _ := h.result(); len(res) != 5 || res[3] != StatusOK || res[4] != StatusOK {
+		t.Fatal(res)
+	}
+	time.Sleep(s.Timer.timeout())
+	if s.clienttx.get(req.clientTransactionKey()) != nil {
+		t.FailNow()
+	}
+}
+
+func Test_ClientTransaction_NonInvite(t *testing.T) {
+	h := &testHandler{}
+	s := newTestServer(h)
+	defer s.closeTest()
+	// Timer E 翻倍，最大 T2 ，Timer F 之后回调 ErrTransactionTimeout
+	conn := newTestConn(true)
+	req := newTestClientRequest(s, MethodMessage)
+	err := s.sendRequest(context.Background(), conn, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := conn.collect(s.Timer.timeout() + 50*time.Millisecond)
+	if len(ws) < 15 {
+		t.Fatalf("%d requests", len(ws))
+	}
+	checkTestIntervals(t, ws, s.Timer.T2)
+	if _, _, errs := h.result(); len(errs) != 1 || errs[0] != ErrTransactionTimeout {
+		t.Fatal(errs)
+	}
+	// 重发的最终响应被吸收，Timer K 之后结束
+	req = newTestClientRequest(s, MethodMessage)
+	err = s.sendRequest(context.Background(), conn, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = conn.next(time.Second)
+	res := newTestResponse(req, StatusOK, "200")
+	s.handleMessage(conn, copyTestMessage(res))
+	s.handleMessage(conn, copyTestMessage(res))
+	time.Sleep(20 * time.Millisecond)
+	if s.clienttx.get(req.clientTransactionKey()) == nil {
+		t.FailNow()
+	}
+	if _, res, _ := h.result(); len(res) != 1 || res[0] != StatusOK {
+		t.Fatal(res)
+	}
+	time.Sleep(s.Timer.T4 + 20*time.Millisecond)
+	if s.clienttx.get(req.clientTransactionKey()) != nil {
+		t.FailNow()
+	}
+	if ws := conn.collect(0); len(ws) != 0 {
+		t.Fatalf("%d retransmissions after final response", len(ws))
+	}
+}
+
+func Test_ClientTransaction_Transport(t *testing.T) {
+	h := &testHandler{}
+	s := newTestServer(h)
+	defer s.closeTest()
+	// tcp 连接，Via 是 TCP ，不重发
+	conn := newTestConn(false)
+	err := s.sendRequest(context.Background(), conn, newTestClientRequest(s, MethodMessage), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := conn.next(time.Second)
+	if req == nil || req.Header.Via[0].Proto != "TCP" {
+		t.FailNow()
+	}
+	if ws := conn.collect(5 * s.Timer.T1); len(ws) != 0 {
+		t.Fatalf("%d retransmissions over tcp", len(ws))
+	}
+	s.handleMessage(conn, copyTestMessage(newTestResponse(req, StatusOK, "200")))
+	time.Sleep(20 * time.Millisecond)
+	if _, res, _ := h.result(); len(res) != 1 || res[0] != StatusOK {
+		t.Fatal(res)
+	}
+	// 保留 tcp 上指定的 TLS
+	var from, to Address
+	from.Parse("<sip:alice@127.0.0.1:5060>")
+	to.Parse("<sip:bob@127.0.0.1:5070>")
+	msg := s.NewRequest(MethodMessage, "sips:bob@127.0.0.1:5070", from, to, WithTransport("tls"))
+	err = s.sendRequest(context.Background(), conn, msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := conn.next(time.Second); req == nil || req.Header.Via[0].Proto != "TLS" {
+		t.FailNow()
+	}
+	// udp 连接，Via 是 UDP
+	conn = newTestConn(true)
+	msg = s.NewRequest(MethodMessage, "sip:bob@127.0.0.1:5070", from, to, WithTransport("tcp"))
+	err = s.sendRequest(context.Background(), conn, msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := conn.next(time.Second); req == nil || req.Header.Via[0].Proto != "UDP" {
+		t.FailNow()
+	}
+}
+
+func Test_ClientTransaction_Cancel(t *testing.T) {
+	h := &testHandler{}
+	s := newTestServer(h)
+	defer s.closeTest()
+	conn := newTestConn(false)
+	// 1xx 之前，收到 1xx 之后才发送 CANCEL
+	req := newTestClientRequest(s, MethodInvite)
+	err := s.sendRequest(context.Background(), conn, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = conn.next(time.Second)
+	err = s.Cancel(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := conn.next(50 * time.Millisecond); m != nil {
+		t.Fatal(m.RequestMethod())
+	}
+	s.handleMessage(conn, newTestResponse(req, StatusRinging, "180"))
+	cancel := conn.next(time.Second)
+	if cancel == nil || cancel.RequestMethod() != MethodCancel ||
+		cancel.Header.Via[0].Branch != req.Header.Via[0].Branch {
+		t.FailNow()
+	}
+	s.handleMessage(conn, newTestResponse(cancel, StatusOK, "180"))
+	s.handleMessage(conn, newTestResponse(req, StatusRequetTerminated, "180"))
+	if m := conn.next(time.Second); m == nil || m.RequestMethod() != MethodACK {
+		t.FailNow()
+	}
+	// 1xx 之后，马上发送 CANCEL
+	req = newTestClientRequest(s, MethodInvite)
+	err = s.sendRequest(context.Background(), conn, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = conn.next(time.Second)
+	s.handleMessage(conn, newTestResponse(req, StatusRinging, "180"))
+	time.Sleep(20 * time.Millisecond)
+	err = s.Cancel(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := conn.next(time.Second); m == nil || m.RequestMethod() != MethodCancel {
+		t.FailNow()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, res, _ := h.result(); len(res) != 3 || res[0] != StatusRinging ||
+		res[1] != StatusRequetTerminated || res[2] != StatusRinging {
+		t.Fatal(res)
+	}
+	// 不是 INVITE
+	req.Header.CSeq.Method = MethodMessage
+	if s.Cancel(req) != errCancelNotInvite {
+		t.FailNow()
+	}
+}
+
+func Test_Server_Do(t *testing.T) {
+	h := &testHandler{}
+	s := newTestServer(h)
+	defer s.closeTest()
+	conn := newTestConn(true)
+	// 返回最终响应，不回调 Handler
+	type result struct {
+		res *Message
+		err error
+	}
+	c := make(chan result, 1)
+	msg := newTestClientRequest(s, MethodMessage)
+	go func() {
+		res, err := s.doRequest(context.Background(), conn, msg, nil)
+		c <- result{res, err}
+	}()
+	req := conn.next(time.Second)
+	if req == nil {
+		t.FailNow()
+	}
+	// 事务已存在
+	_, err := s.DoWithConn(context.Background(), conn, msg)
+	var te *TransactionError
+	if !errors.As(err, &te) || te.Err != ErrTransactionExists {
+		t.Fatal(err)
+	}
+	s.handleMessage(conn, copyTestMessage(newTestResponse(req, StatusOK, "200")))
+	r := <-c
+	if r.err != nil || r.res == nil || r.res.ResponseStatus() != StatusOK {
+		t.Fatal(r.err)
+	}
+	// 超时返回 ErrTransactionTimeout
+	res, err := s.DoWithConn(context.Background(), conn, newTestClientRequest(s, MethodMessage))
+	if res != nil || !errors.As(err, &te) || te.Err != ErrTransactionTimeout || te.Status() != StatusRequestTimeout {
+		t.Fatal(err)
+	}
+	if _, res, errs := h.result(); len(res) != 0 || len(errs) != 0 {
+		t.Fatal(res, errs)
+	}
+}
+
+func Test_Server_DoProvisional(t *testing.T) {
+	h := &testHandler{}
+	s := newTestServer(h)
+	defer s.closeTest()
+	conn := newTestConn(true)
+	// 1xx 按顺序回调，重发的不回调，1xx 停止重发
+	var provisional []string
+	c := make(chan *Message, 1)
+	go func() {
+		res, _ := s.doRequest(context.Background(), conn, newTestClientRequest(s, MethodInvite), func(m *Message) {
+			provisional = append(provisional, m.ResponseStatus())
+		})
+		c <- res
+	}()
+	req := conn.next(time.Second)
+	if req == nil {
+		t.FailNow()
+	}
+	for _, m := range []*Message{
+		newTestResponse(req, StatusTrying, ""),
+		newTestResponse(req, StatusRinging, "1"),
+		newTestResponse(req, StatusRinging, "1"),
+		newTestResponse(req, StatusSessionProgress, "1"),
+	} {
+		s.handleMessage(conn, m)
+	}
+	if ws := conn.collect(4 * s.Timer.T1); len(ws) != 0 {
+		t.Fatalf("%d retransmissions after 1xx", len(ws))
+	}
+	s.handleMessage(conn, newTestResponse(req, StatusOK, "1"))
+	res := <-c
+	if res == nil || res.ResponseStatus() != StatusOK {
+		t.FailNow()
+	}
+	if len(provisional) != 3 || provisional[0] != StatusTrying ||
+		provisional[1] != StatusRinging || provisional[2] != StatusSessionProgress {
+		t.Fatal(provisional)
+	}
+	// 异步回调 Handler
+	err := s.sendRequest(context.Background(), conn, newTestClientRequest(s, MethodInvite), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = conn.next(time.Second)
+	for _, m := range []*Message{
+		newTestResponse(req, StatusRinging, "2"),
+		newTestResponse(req, StatusRinging, "2"),
+		newTestResponse(req, StatusSessionProgress, "2"),
+		newTestResponse(req, StatusOK, "2"),
+	} {
+		s.handleMessage(conn, m)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, res, _ := h.result(); len(res) != 3 || res[0] != StatusRinging ||
+		res[1] != StatusSessionProgress || res[2] != StatusOK {
+		t.Fatal(res)
+	}
+}
+
+// testFailConn 发送 n 个消息之后失败
+type testFailConn struct {
+	*testConn
+	n int32
+}
+
+var errTestWrite = errors.New("test write")
+
+func (c *testFailConn) write(b []byte) error {
+	if atomic.AddInt32(&c.n, -1) < 0 {
+		return errTestWrite
+	}
+	return c.testConn.write(b)
+}
+
+func Test_ClientTransaction_Error(t *testing.T) {
+	h := &testHandler{}
+	s := newTestServer(h)
+	// 第一次发送失败
+	_, err := s.DoWithConn(context.Background(), &testFailConn{testConn: newTestConn(true)}, newTestClientRequest(s, MethodMessage))
+	var te *TransactionError
+	if !errors.As(err, &te) || te.Err != ErrTransportFailure || te.Cause != errTestWrite || te.Status() != StatusServiceUnavailable {
+		t.Fatal(err)
+	}
+	// 重发失败
+	conn := &testFailConn{testConn: newTestConn(true), n: 1}
+	err = s.sendRequest(context.Background(), conn, newTestClientRequest(s, MethodMessage), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * s.Timer.T1)
+	// ctx 取消
+	ctx, cancel := context.WithCancel(context.Background())
+	err = s.sendRequest(ctx, newTestConn(true), newTestClientRequest(s, MethodMessage), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	// 服务关闭
+	err = s.sendRequest(context.Background(), newTestConn(true), newTestClientRequest(s, MethodInvite), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.closeTest()
+	_, _, errs := h.result()
+	if len(errs) != 3 || errs[0] != ErrTransportFailure ||
+		errs[1] != ErrTransactionCanceled || errs[2] != ErrTransactionCanceled {
+		t.Fatal(errs)
+	}
+}
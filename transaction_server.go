@@ -0,0 +1,618 @@
+package sip
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/qq51529210/log"
+	"github.com/qq51529210/uuid"
+)
+
+// serverTransactions 表示服务端事务表
+type serverTransactions struct {
+	sync.RWMutex
+	t map[string]*serverTransaction
+	// INVITE 事务，用于匹配 2xx 的 ACK ，它的 branch 和 INVITE 不一样
+	ack map[string]*serverTransaction
+}
+
+// init 初始化
+func (t *serverTransactions) init() {
+	t.t = make(map[string]*serverTransaction)
+	t.ack = make(map[string]*serverTransaction)
+}
+
+// ackKey 返回 ack 表的 key
+func ackKey(msg *Message) string {
+	return msg.Header.CallID + "\n" + msg.Header.From.Tag + "\n" + strconv.FormatUint(uint64(msg.Header.CSeq.SN), 10)
+}
+
+// new 根据从 conn 收到的 msg 返回 tx ，如果是新建的，返回 true
+func (t *serverTransactions) new(s *Server, msg *Message, conn Conn) (*serverTransaction, bool) {
+	key := msg.TransactionKey()
+	// 查询，大多数重发的请求在这里返回
+	tt := t.get(key)
+	if tt != nil {
+		return tt, false
+	}
+	t.Lock()
+	tt = t.t[key]
+	// 已存在
+	if tt != nil {
+		t.Unlock()
+		//
+		return tt, false
+	}
+	// 新的
+	tt = &serverTransaction{
+		key:    key,
+		method: msg.Header.CSeq.Method,
+		conn:   conn,
+		udp:    conn.isUDP(),
+		timer:  s.getTimer(conn),
+		s:      s,
+		req:    new(Message),
+		signal: make(chan struct{}, 1),
+	}
+	tt.ctx, tt.cancel = context.WithCancel(context.Background())
+	msg.CopyTo(tt.req)
+	if tt.method == MethodInvite {
+		tt.state = txStateProceeding
+		t.ack[ackKey(msg)] = tt
+	} else {
+		tt.state = txStateTrying
+	}
+	t.t[key] = tt
+	t.Unlock()
+	//
+	return tt, true
+}
+
+// get 根据 key 返回 tx
+func (t *serverTransactions) get(key string) *serverTransaction {
+	t.RLock()
+	tt := t.t[key]
+	t.RUnlock()
+	//
+	return tt
+}
+
+// getACK 返回 2xx 的 ACK 对应的 INVITE 事务
+func (t *serverTransactions) getACK(msg *Message) *serverTransaction {
+	t.RLock()
+	tt := t.ack[ackKey(msg)]
+	t.RUnlock()
+	//
+	return tt
+}
+
+// rm 移除 tt
+func (t *serverTransactions) rm(tt *serverTransaction) {
+	t.Lock()
+	if t.t[tt.key] == tt {
+		delete(t.t, tt.key)
+	}
+	if tt.method == MethodInvite {
+		key := ackKey(tt.req)
+		if t.ack[key] == tt {
+			delete(t.ack, key)
+		}
+	}
+	t.Unlock()
+}
+
+// serverTransaction 表示一个收到请求的服务端事务
+type serverTransaction struct {
+	// 事务表的 key
+	key string
+	// 请求方法，区分 INVITE 和非 INVITE 事务
+	method string
+	// 发送响应的连接，RFC 3261 18.2.2 ，事务协程解析 Via 和 tcp 重连时会替换，使用锁保护
+	conn Conn
+	// conn 是否 udp ，不会变化，不需要锁
+	udp bool
+	// 保证 writeMessage 按顺序发送，发送时不持有下面的锁
+	writeLock sync.Mutex
+	// 用于 tcp 重连
+	s *Server
+	// 定时器
+	timer Timer
+	// Request.Context ，收到 CANCEL 或者事务结束时取消
+	ctx    context.Context
+	cancel context.CancelFunc
+	// 请求消息的拷贝，用于生成本地的响应
+	req *Message
+	// 保护下面的字段
+	sync.Mutex
+	// 状态
+	state int32
+	// 响应的 To 的 tag
+	toTag string
+	// Accepted 状态是否收到了 2xx 的 ACK
+	acked bool
+	// 最后发送的响应消息数据，用于回应重发的请求
+	resData bytes.Buffer
+	// 状态变化的信号
+	signal chan struct{}
+}
+
+func (t *serverTransaction) Key() string {
+	return t.key
+}
+
+// writeMessage 发送响应消息 msg ，并根据状态码修改事务的状态。
+// 响应使用 t.conn 发送，而不是 conn
+func (t *serverTransaction) writeMessage(_ Conn, msg *Message) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	t.Lock()
+	// 已经发送过最终响应
+	if t.state != txStateTrying && t.state != txStateProceeding {
+		t.Unlock()
+		return errTXFinish
+	}
+	// 状态
+	switch msg.statusClass() {
+	case '1':
+		t.state = txStateProceeding
+	case '2':
+		if t.method == MethodInvite {
+			// 重发 2xx 直到收到 ACK
+			t.state = txStateAccepted
+		} else {
+			t.state = txStateCompleted
+		}
+	default:
+		t.state = txStateCompleted
+	}
+	t.notify()
+	if msg.Header.To.Tag != "" {
+		t.toTag = msg.Header.To.Tag
+	}
+	// 发送
+	t.resData.Reset()
+	msg.FormatTo(&t.resData)
+	b := append([]byte(nil), t.resData.Bytes()...)
+	log.DebugfTrace(t.key, "write %s %s:%s\n%s", t.conn.Network(), t.conn.RemoteIP(), t.conn.RemotePort(), t.resData.String())
+	t.Unlock()
+	return t.write(b)
+}
+
+// write 使用 t.conn 发送数据，tcp 发送失败的，根据 Via 重新建立连接再发送，RFC 3261 18.2.2 。
+// 调用时不能持有锁，建立连接可能很久
+func (t *serverTransaction) write(b []byte) error {
+	conn := t.getConn()
+	err := conn.write(b)
+	if err == nil || t.udp {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.s.WriteTimeout)
+	defer cancel()
+	conn, err = t.s.dialResponseConn(ctx, t.req)
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	t.conn = conn
+	t.Unlock()
+	return conn.write(b)
+}
+
+// writeTrying 在 INVITE 还没有发送任何响应时发送本地的 100 ，RFC 3261 17.2.1
+func (t *serverTransaction) writeTrying(msg *Message) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	t.Lock()
+	// Handler 已经发送过响应
+	if t.state != txStateProceeding || t.resData.Len() > 0 {
+		t.Unlock()
+		return nil
+	}
+	// 发送，保存用于回应重发的请求
+	msg.FormatTo(&t.resData)
+	b := append([]byte(nil), t.resData.Bytes()...)
+	t.Unlock()
+	return t.write(b)
+}
+
+// getResData 返回最后发送的响应消息数据的拷贝，没有返回 nil
+func (t *serverTransaction) getResData() []byte {
+	t.Lock()
+	defer t.Unlock()
+	if t.resData.Len() < 1 {
+		return nil
+	}
+	return append([]byte(nil), t.resData.Bytes()...)
+}
+
+// notify 通知事务协程状态已经变化
+func (t *serverTransaction) notify() {
+	select {
+	case t.signal <- struct{}{}:
+	default:
+	}
+}
+
+// handleRequest 处理重发的请求，使用最后一个响应回应，不会再回调 Handler 。
+// INVITE 还没有响应的，回应 100
+func (t *serverTransaction) handleRequest(msg *Message) {
+	// 2xx 的重发由事务协程负责
+	switch t.getState() {
+	case txStateTrying, txStateConfirmed, txStateTerminated, txStateAccepted:
+		return
+	}
+	b := t.getResData()
+	if b == nil {
+		// INVITE 还没有响应，立即回应 100
+		if t.method == MethodInvite {
+			t.s.serverTransactionTrying(t)
+		}
+		return
+	}
+	err := t.write(b)
+	if err != nil {
+		log.ErrorTrace(t.key, err)
+		return
+	}
+	log.DebugTrace(t.key, "retransmission")
+}
+
+// handleACK 处理 ACK ，非 2xx 的 ACK 被事务吸收，返回 true
+func (t *serverTransaction) handleACK() bool {
+	t.Lock()
+	defer t.Unlock()
+	switch t.state {
+	case txStateCompleted:
+		t.state = txStateConfirmed
+		t.notify()
+		return true
+	case txStateConfirmed:
+		return true
+	case txStateAccepted:
+		// 2xx 的 ACK ，停止重发，继续吸收重发的 INVITE 直到 Timer L
+		if !t.acked {
+			t.acked = true
+			t.notify()
+		}
+	}
+	return false
+}
+
+// getToTag 返回响应使用的 To 的 tag ，没有则生成一个
+func (t *serverTransaction) getToTag() string {
+	t.Lock()
+	defer t.Unlock()
+	if t.toTag == "" {
+		t.toTag = uuid.SnowflakeIDString()
+	}
+	return t.toTag
+}
+
+// getConn 返回发送响应的连接
+func (t *serverTransaction) getConn() Conn {
+	t.Lock()
+	defer t.Unlock()
+	return t.conn
+}
+
+// getState 返回状态
+func (t *serverTransaction) getState() int32 {
+	t.Lock()
+	defer t.Unlock()
+	return t.state
+}
+
+// isACKed 返回 Accepted 状态是否收到了 ACK
+func (t *serverTransaction) isACKed() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.acked
+}
+
+// handleServerTransactionMessage 处理收到的请求消息，
+// 新的事务启动协程回调处理，已有的事务吸收重发的请求
+func (s *Server) handleServerTransactionMessage(conn Conn, msg *Message) {
+	if msg.Header.CSeq.Method == MethodACK {
+		s.handleACKMessage(conn, msg)
+		return
+	}
+	t, ok := s.servertx.new(s, msg, conn)
+	if ok {
+		s.wg.Add(1)
+		go s.serverTransactionRoutine(t, conn, msg)
+		return
+	}
+	t.handleRequest(msg)
+	s.msgPool.Put(msg)
+}
+
+// handleACKMessage 处理收到的 ACK ，RFC 3261 17.2.1 。
+// 非 2xx 的 ACK 被 INVITE 事务吸收，2xx 的 ACK 不创建事务，停止 2xx 的重发后启动协程回调
+func (s *Server) handleACKMessage(conn Conn, msg *Message) {
+	// 非 2xx 的 ACK ，和 INVITE 的 branch 一样
+	t := s.servertx.get(msg.TransactionKey())
+	if t != nil && t.handleACK() {
+		s.msgPool.Put(msg)
+		return
+	}
+	// 2xx 的 ACK
+	t = s.servertx.getACK(msg)
+	if t != nil {
+		t.handleACK()
+	}
+	s.wg.Add(1)
+	go s.ackRoutine(conn, msg)
+}
+
+// ackRoutine 回调处理 2xx 的 ACK
+func (s *Server) ackRoutine(conn Conn, msg *Message) {
+	defer func() {
+		// 回收
+		s.msgPool.Put(msg)
+		// 协程结束
+		s.wg.Done()
+	}()
+	req := &Request{
+		transaction: ackTransaction(msg.TransactionKey()),
+		Conn:        conn,
+		Message:     msg,
+		s:           s,
+		Context:     context.Background(),
+		Dialog:      s.MatchDialog(msg),
+	}
+	if h, ok := s.Handler.(ACKHandler); ok {
+		h.HandleACK(req)
+		return
+	}
+	s.Handler.HandleRequest(req)
+}
+
+// ackTransaction 是 2xx 的 ACK 的 Request 使用的 transaction ，不能发送响应
+type ackTransaction string
+
+func (t ackTransaction) Key() string {
+	return string(t)
+}
+
+func (t ackTransaction) writeMessage(Conn, *Message) error {
+	return errACKResponse
+}
+
+// serverTransactionRoutine 回调处理从 conn 收到的请求消息，RFC 3261 17.2 。
+// 状态机在另一个协程运行，Handler 可以返回后再异步发送响应
+func (s *Server) serverTransactionRoutine(t *serverTransaction, conn Conn, msg *Message) {
+	defer s.wg.Done()
+	// 响应的连接，maddr 可能需要解析域名，不在读取消息的协程
+	if rconn := s.responseConn(conn, msg); rconn != conn {
+		t.Lock()
+		t.conn = rconn
+		t.Unlock()
+	}
+	// 状态机
+	s.wg.Add(1)
+	go s.serverTransactionStateRoutine(t)
+	// Handler 返回后还可能使用 msg ，不回收
+	req := &Request{transaction: t, Conn: conn, Message: msg, s: s, Context: t.ctx}
+	// 对话
+	req.Dialog = s.MatchDialog(msg)
+	if t.method == MethodCancel {
+		// CANCEL 不回调
+		s.handleServerTransactionCancel(t, msg)
+		return
+	}
+	if req.Dialog != nil &&
+		!req.Dialog.checkRemoteSeq(msg.Header.CSeq.SN) {
+		// CSeq 乱序，RFC 3261 12.2.2
+		err := req.Response(StatusServerInternalError, "")
+		if err != nil {
+			log.ErrorTrace(t.key, err)
+		}
+		return
+	}
+	// 目标刷新
+	if req.Dialog != nil {
+		req.Dialog.refreshTarget(msg)
+	}
+	// 回调处理
+	s.Handler.HandleRequest(req)
+}
+
+// serverTransactionStateRoutine 运行服务端事务的状态机，发送响应时由 writeMessage 通知。
+// 在最终响应之前，INVITE 在 TryingDelay 内没有响应则回应 100 ，等待 Timer C ，超时回应 408 ；
+// 非 INVITE 等待 64*T1 ，超时事务结束
+func (s *Server) serverTransactionStateRoutine(t *serverTransaction) {
+	// 计时器
+	var timer100, timerC, timerG, timerH, timerIJ, timerL txTimer
+	// 退出清理
+	defer func() {
+		timer100.Stop()
+		timerC.Stop()
+		timerG.Stop()
+		timerH.Stop()
+		timerIJ.Stop()
+		timerL.Stop()
+		// 之后不能再发送响应
+		t.Lock()
+		t.state = txStateTerminated
+		t.Unlock()
+		// 移除
+		s.servertx.rm(t)
+		t.cancel()
+		// 协程结束
+		s.wg.Done()
+	}()
+	// 等待最终响应
+	if t.method == MethodInvite {
+		timer100.Start(TryingDelay)
+		timerC.Start(t.timer.C)
+	} else {
+		timerC.Start(t.timer.timeout())
+	}
+	rto := t.timer.T1
+	for {
+		switch t.getState() {
+		case txStateTrying, txStateProceeding:
+			// 等待 Handler 发送最终响应
+		case txStateTerminated:
+			return
+		case txStateCompleted:
+			timer100.Stop()
+			timerC.Stop()
+			if timerH.C != nil || timerIJ.C != nil {
+				break
+			}
+			if t.method != MethodInvite {
+				// Timer J ，可靠传输为 0
+				if !t.udp {
+					return
+				}
+				timerIJ.Start(t.timer.timeout())
+				break
+			}
+			// Timer G ，只有 udp 需要重发
+			if t.udp {
+				timerG.Start(rto)
+			}
+			// Timer H ，等待 ACK
+			timerH.Start(t.timer.timeout())
+		case txStateAccepted:
+			timer100.Stop()
+			timerC.Stop()
+			// 收到 ACK ，停止重发 2xx
+			if t.isACKed() {
+				timerG.Stop()
+			}
+			if timerL.C != nil {
+				break
+			}
+			// 重发 2xx ，只有 udp 需要，RFC 3261 13.3.1.4
+			if t.udp {
+				timerG.Start(rto)
+			}
+			// Timer L ，吸收重发的 INVITE 和等待 ACK ，RFC 6026 7.1
+			timerL.Start(t.timer.timeout())
+		case txStateConfirmed:
+			if timerIJ.C != nil {
+				break
+			}
+			timerG.Stop()
+			timerH.Stop()
+			// Timer I ，可靠传输为 0
+			if !t.udp {
+				return
+			}
+			timerIJ.Start(t.timer.T4)
+		}
+		select {
+		case <-s.quit.c:
+			return
+		case <-t.signal:
+		case <-timer100.C:
+			// Handler 没有及时发送响应
+			s.serverTransactionTrying(t)
+		case <-timerC.C:
+			// 没有最终响应
+			log.ErrorTrace(t.key, ErrTransactionTimeout)
+			if t.method != MethodInvite {
+				return
+			}
+			res := s.newLocalResponse(t.req, StatusRequestTimeout)
+			res.Header.To.Tag = t.getToTag()
+			err := t.writeMessage(nil, res)
+			s.msgPool.Put(res)
+			if err != nil && err != errTXFinish {
+				log.ErrorTrace(t.key, err)
+				return
+			}
+			// 通知 Handler
+			t.cancel()
+		case <-timerG.C:
+			// 已经收到 2xx 的 ACK
+			if t.isACKed() {
+				break
+			}
+			// 重发最终响应，间隔翻倍，最大 T2
+			err := t.write(t.getResData())
+			if err != nil {
+				log.ErrorTrace(t.key, err)
+				return
+			}
+			log.DebugTrace(t.key, "retransmission")
+			rto = t.timer.nextRTO(rto)
+			timerG.Start(rto)
+		case <-timerH.C:
+			// 没有收到 ACK
+			log.ErrorTrace(t.key, ErrTransactionTimeout)
+			return
+		case <-timerL.C:
+			// 没有收到 2xx 的 ACK
+			if !t.isACKed() {
+				s.serverTransactionACKTimeout(t)
+			}
+			return
+		case <-timerIJ.C:
+			return
+		}
+	}
+}
+
+// serverTransactionTrying 在 INVITE 事务 t 还没有发送任何响应时回应 100
+func (s *Server) serverTransactionTrying(t *serverTransaction) {
+	res := s.newLocalResponse(t.req, StatusTrying)
+	err := t.writeTrying(res)
+	s.msgPool.Put(res)
+	if err != nil {
+		log.ErrorTrace(t.key, err)
+	}
+}
+
+// handleServerTransactionCancel 处理 CANCEL ，t 是 CANCEL 的事务。
+// 匹配到 INVITE 事务，回应 200 ，如果 INVITE 还没有最终响应，回应 487 并取消 Request.Context ；
+// 匹配不到，回应 481 ，RFC 3261 9.2
+func (s *Server) handleServerTransactionCancel(t *serverTransaction, msg *Message) {
+	it := s.servertx.get(msg.transactionKey(MethodInvite))
+	// 回应 CANCEL
+	var res *Message
+	if it != nil {
+		res = s.newLocalResponse(msg, StatusOK)
+		res.Header.To.Tag = it.getToTag()
+	} else {
+		res = s.newLocalResponse(msg, StatusCallOrTransactionDoesNotExist)
+		res.Header.To.Tag = t.getToTag()
+	}
+	err := t.writeMessage(nil, res)
+	if err != nil {
+		log.ErrorTrace(t.key, err)
+	}
+	s.msgPool.Put(res)
+	if it == nil {
+		return
+	}
+	// 回应 INVITE ，已经有最终响应的会返回 errTXFinish
+	res = s.newLocalResponse(it.req, StatusRequetTerminated)
+	res.Header.To.Tag = it.getToTag()
+	err = it.writeMessage(nil, res)
+	if err != nil && err != errTXFinish {
+		log.ErrorTrace(it.key, err)
+	}
+	s.msgPool.Put(res)
+	// 通知 Handler
+	it.cancel()
+}
+
+// serverTransactionACKTimeout 通知 2xx 没有收到 ACK
+func (s *Server) serverTransactionACKTimeout(t *serverTransaction) {
+	e := &TransactionError{
+		Key:     t.key,
+		Err:     ErrACKTimeout,
+		Request: t.req,
+		Conn:    t.getConn(),
+	}
+	if h, ok := s.Handler.(ErrorHandler); ok {
+		h.HandleError(e)
+		return
+	}
+	log.ErrorTrace(t.key, e)
+}
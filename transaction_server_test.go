@@ -0,0 +1,325 @@
+package sip
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ServerTransaction_Invite(t *testing.T) {
+	h := &testHandler{}
+	h.onRequest = func(r *Request) {
+		r.Response(StatusRinging, "")
+		// 异步发送最终响应
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			r.Response(StatusBusyHere, "")
+		}()
+	}
+	s := newTestServer(h)
+	defer s.closeTest()
+	// Handler 返回后事务还在，重发的请求回应最后的 1xx ，不再回调
+	conn := newTestConn(true)
+	req := newTestRequest(MethodInvite)
+	s.handleMessage(conn, copyTestMessage(req))
+	if m := conn.next(time.Second); m == nil || m.ResponseStatus() != StatusRinging {
+		t.FailNow()
+	}
+	time.Sleep(20 * time.Millisecond)
+	s.handleMessage(conn, copyTestMessage(req))
+	if m := conn.next(time.Second); m == nil || m.ResponseStatus() != StatusRinging {
+		t.FailNow()
+	}
+	// Timer G 翻倍，最大 T2 ，Timer H 之后结束
+	ws := conn.collect(s.Timer.timeout() + 100*time.Millisecond)
+	if len(ws) < 15 || ws[0].msg.ResponseStatus() != StatusBusyHere {
+		t.Fatalf("%d responses", len(ws))
+	}
+	checkTestIntervals(t, ws, s.Timer.T2)
+	if s.servertx.get(req.TransactionKey()) != nil {
+		t.FailNow()
+	}
+	// ACK 停止重发，Timer I 之后结束
+	req = newTestRequest(MethodInvite)
+	s.handleMessage(conn, copyTestMessage(req))
+	conn.next(time.Second)
+	res := conn.next(time.Second)
+	if res == nil || res.ResponseStatus() != StatusBusyHere {
+		t.FailNow()
+	}
+	s.handleMessage(conn, newACK(req, res))
+	time.Sleep(s.Timer.T4 / 2)
+	if s.servertx.get(req.TransactionKey()) == nil {
+		t.FailNow()
+	}
+	time.Sleep(s.Timer.T4)
+	if s.servertx.get(req.TransactionKey()) != nil {
+		t.FailNow()
+	}
+	if ws := conn.collect(0); len(ws) > 1 {
+		t.Fatalf("%d retransmissions after ACK", len(ws))
+	}
+	if req, _, _ := h.result(); len(req) != 2 {
+		t.Fatal(req)
+	}
+	// 没有最终响应，先回应 100 ，Timer C 回应 408
+	h.onRequest = nil
+	req = newTestRequest(MethodInvite)
+	s.handleMessage(conn, copyTestMessage(req))
+	if m := conn.next(TryingDelay + 50*time.Millisecond); m == nil || m.ResponseStatus() != StatusTrying {
+		t.FailNow()
+	}
+	if m := conn.next(s.Timer.C); m == nil || m.ResponseStatus() != StatusRequestTimeout {
+		t.FailNow()
+	}
+}
+
+func Test_ServerTransaction_Trying(t *testing.T) {
+	h := &testHandler{}
+	h.onRequest = func(r *Request) {
+		// 异步发送最终响应
+		go func() {
+			time.Sleep(TryingDelay + 100*time.Millisecond)
+			r.Response(StatusOK, "")
+		}()
+	}
+	s := newTestServer(h)
+	defer s.closeTest()
+	conn := newTestConn(true)
+	// 没有响应，重发的 INVITE 立即回应 100
+	req := newTestRequest(MethodInvite)
+	s.handleMessage(conn, copyTestMessage(req))
+	time.Sleep(20 * time.Millisecond)
+	s.handleMessage(conn, copyTestMessage(req))
+	m := conn.next(50 * time.Millisecond)
+	if m == nil || m.ResponseStatus() != StatusTrying || m.Header.To.Tag != "" {
+		t.FailNow()
+	}
+	// 已经回应过 100 ，TryingDelay 之后不再发送
+	if m := conn.next(TryingDelay); m != nil {
+		t.Fatal(m.ResponseStatus())
+	}
+	// 重发的 INVITE 回应 100
+	s.handleMessage(conn, copyTestMessage(req))
+	if m := conn.next(50 * time.Millisecond); m == nil || m.ResponseStatus() != StatusTrying {
+		t.FailNow()
+	}
+	// 最终响应
+	if m := conn.next(time.Second); m == nil || m.ResponseStatus() != StatusOK {
+		t.FailNow()
+	}
+	// Handler 在 TryingDelay 内发送 1xx ，不回应 100
+	h.onRequest = func(r *Request) {
+		r.Response(StatusRinging, "")
+	}
+	req = newTestRequest(MethodInvite)
+	s.handleMessage(conn, copyTestMessage(req))
+	ws := conn.collect(TryingDelay + 50*time.Millisecond)
+	for _, w := range ws {
+		if w.msg.Header.CallID == req.Header.CallID && w.msg.ResponseStatus() == StatusTrying {
+			t.Fatal("100 after 180")
+		}
+	}
+}
+
+func Test_ServerTransaction_NonInvite(t *testing.T) {
+	h := &testHandler{}
+	h.onRequest = func(r *Request) {
+		r.Response(StatusOK, "")
+	}
+	s := newTestServer(h)
+	defer s.closeTest()
+	// 重发的请求回应最后的响应，不再回调，Timer J 之后结束
+	conn := newTestConn(true)
+	req := newTestRequest(MethodMessage)
+	s.handleMessage(conn, copyTestMessage(req))
+	if m := conn.next(time.Second); m == nil || m.ResponseStatus() != StatusOK {
+		t.FailNow()
+	}
+	s.handleMessage(conn, copyTestMessage(req))
+	if m := conn.next(time.Second); m == nil || m.ResponseStatus() != StatusOK {
+		t.FailNow()
+	}
+	if req, _, _ := h.result(); len(req) != 1 {
+		t.Fatal(req)
+	}
+	time.Sleep(s.Timer.timeout() / 2)
+	if s.servertx.get(req.TransactionKey()) == nil {
+		t.FailNow()
+	}
+	time.Sleep(s.Timer.timeout()/2 + 50*time.Millisecond)
+	if s.servertx.get(req.TransactionKey()) != nil {
+		t.FailNow()
+	}
+	// 可靠传输 Timer J 为 0
+	conn = newTestConn(false)
+	req = newTestRequest(MethodMessage)
+	s.handleMessage(conn, copyTestMessage(req))
+	conn.next(time.Second)
+	time.Sleep(20 * time.Millisecond)
+	if s.servertx.get(req.TransactionKey()) != nil {
+		t.FailNow()
+	}
+}
+
+func Test_ServerTransaction_ACKTimeout(t *testing.T) {
+	h := &testHandler{}
+	h.onRequest = func(r *Request) {
+		if r.RequestMethod() == MethodInvite {
+			r.Response(StatusOK, "")
+		}
+	}
+	s := newTestServer(h)
+	defer s.closeTest()
+	conn := newTestConn(true)
+	// 收到 ACK ，停止重发 2xx ，重发的 INVITE 被吸收，Timer L 之后结束
+	req := newTestRequest(MethodInvite)
+	s.handleMessage(conn, copyTestMessage(req))
+	res := conn.next(time.Second)
+	if res == nil || res.ResponseStatus() != StatusOK {
+		t.FailNow()
+	}
+	ack := newACK(req, res)
+	ack.Header.Via[0].Branch = NewBranch()
+	s.handleMessage(conn, ack)
+	time.Sleep(20 * time.Millisecond)
+	conn.collect(0)
+	s.handleMessage(conn, copyTestMessage(req))
+	if ws := conn.collect(s.Timer.timeout() / 2); len(ws) != 0 {
+		t.Fatalf("%d messages after ACK", len(ws))
+	}
+	if s.servertx.get(req.TransactionKey()) == nil {
+		t.FailNow()
+	}
+	time.Sleep(s.Timer.timeout()/2 + 50*time.Millisecond)
+	if s.servertx.get(req.TransactionKey()) != nil {
+		t.FailNow()
+	}
+	if req, _, errs := h.result(); len(req) != 2 || req[1] != MethodACK || len(errs) != 0 {
+		t.Fatal(req, errs)
+	}
+	// 没有 ACK
+	req = newTestRequest(MethodInvite)
+	s.handleMessage(conn, copyTestMessage(req))
+	time.Sleep(s.Timer.timeout() + 50*time.Millisecond)
+	if _, _, errs := h.result(); len(errs) != 1 || errs[0] != ErrACKTimeout {
+		t.Fatal(errs)
+	}
+}
+
+func Test_ServerTransaction_Cancel(t *testing.T) {
+	h := &testHandler{}
+	canceled := make(chan struct{})
+	h.onRequest = func(r *Request) {
+		r.Response(StatusRinging, "")
+		// 等待取消
+		go func() {
+			<-r.Context.Done()
+			close(canceled)
+		}()
+	}
+	s := newTestServer(h)
+	defer s.closeTest()
+	conn := newTestConn(true)
+	req := newTestRequest(MethodInvite)
+	s.handleMessage(conn, copyTestMessage(req))
+	res := conn.next(time.Second)
+	if res == nil || res.ResponseStatus() != StatusRinging {
+		t.FailNow()
+	}
+	// CANCEL 回应 200 ，INVITE 回应 487 ，To 的 tag 一样
+	s.handleMessage(conn, newCancel(req))
+	m := conn.next(time.Second)
+	if m == nil || m.Header.CSeq.Method != MethodCancel || m.ResponseStatus() != StatusOK ||
+		m.Header.To.Tag != res.Header.To.Tag {
+		t.FailNow()
+	}
+	m = conn.next(time.Second)
+	if m == nil || m.Header.CSeq.Method != MethodInvite || m.ResponseStatus() != StatusRequetTerminated ||
+		m.Header.To.Tag != res.Header.To.Tag {
+		t.FailNow()
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("Request.Context is not canceled")
+	}
+	// CANCEL 不回调
+	if req, _, _ := h.result(); len(req) != 1 || req[0] != MethodInvite {
+		t.Fatal(req)
+	}
+	// 匹配不到 INVITE ，回应 481
+	s.handleMessage(conn, newCancel(newTestRequest(MethodInvite)))
+	for {
+		m = conn.next(time.Second)
+		if m == nil || m.Header.CSeq.Method == MethodCancel {
+			break
+		}
+	}
+	if m == nil || m.ResponseStatus() != StatusCallOrTransactionDoesNotExist {
+		t.FailNow()
+	}
+}
+
+// testACKHandler 实现了 ACKHandler
+type testACKHandler struct {
+	*testHandler
+	acks chan *Request
+}
+
+func (h testACKHandler) HandleACK(r *Request) {
+	h.acks <- r
+}
+
+func Test_ServerTransaction_HandleACK(t *testing.T) {
+	h := testACKHandler{testHandler: &testHandler{}, acks: make(chan *Request, 4)}
+	h.onRequest = func(r *Request) {
+		if r.RequestMethod() == MethodInvite {
+			r.Response(StatusOK, "")
+		}
+	}
+	s := newTestServer(h)
+	defer s.closeTest()
+	conn := newTestConn(true)
+	// 2xx 的 ACK 回调 HandleACK ，不能响应
+	req := newTestRequest(MethodInvite)
+	s.handleMessage(conn, copyTestMessage(req))
+	res := conn.next(time.Second)
+	if res == nil || res.ResponseStatus() != StatusOK {
+		t.FailNow()
+	}
+	ack := newACK(req, res)
+	ack.Header.Via[0].Branch = NewBranch()
+	s.handleMessage(conn, ack)
+	select {
+	case r := <-h.acks:
+		if r.RequestMethod() != MethodACK || r.Response(StatusOK, "") != errACKResponse {
+			t.FailNow()
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no HandleACK")
+	}
+	// 非 2xx 的 ACK 被事务吸收
+	h.onRequest = func(r *Request) {
+		r.Response(StatusBusyHere, "")
+	}
+	req = newTestRequest(MethodInvite)
+	s.handleMessage(conn, copyTestMessage(req))
+	for {
+		res = conn.next(time.Second)
+		if res == nil || res.Header.CallID == req.Header.CallID {
+			break
+		}
+	}
+	if res == nil || res.ResponseStatus() != StatusBusyHere {
+		t.FailNow()
+	}
+	s.handleMessage(conn, newACK(req, res))
+	select {
+	case <-h.acks:
+		t.Fatal("HandleACK for non-2xx")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if req, _, _ := h.result(); len(req) != 2 || req[0] != MethodInvite || req[1] != MethodInvite {
+		t.Fatal(req)
+	}
+}
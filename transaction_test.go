@@ -0,0 +1,215 @@
+package sip
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testConn 是测试使用的内存连接，记录发送的消息
+type testConn struct {
+	udp bool
+	c   chan testWrite
+}
+
+// testWrite 表示 testConn 发送的一个消息
+type testWrite struct {
+	msg  *Message
+	time time.Time
+}
+
+func newTestConn(udp bool) *testConn {
+	return &testConn{udp: udp, c: make(chan testWrite, 128)}
+}
+
+func (c *testConn) Network() string {
+	if c.udp {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5070}
+}
+
+func (c *testConn) RemoteIP() string {
+	return "127.0.0.1"
+}
+
+func (c *testConn) RemotePort() string {
+	return "5070"
+}
+
+func (c *testConn) RemoteAddrString() string {
+	return "127.0.0.1:5070"
+}
+
+func (c *testConn) isUDP() bool {
+	return c.udp
+}
+
+func (c *testConn) write(b []byte) error {
+	msg := new(Message)
+	err := msg.ParseFrom(NewReader(bytes.NewBuffer(append([]byte(nil), b...)), -1), UDPMaxDataLen)
+	if err != nil {
+		return err
+	}
+	c.c <- testWrite{msg: msg, time: time.Now()}
+	return nil
+}
+
+// next 返回 d 内发送的下一个消息，没有返回 nil
+func (c *testConn) next(d time.Duration) *Message {
+	select {
+	case w := <-c.c:
+		return w.msg
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// collect 返回 d 内发送的所有消息
+func (c *testConn) collect(d time.Duration) []testWrite {
+	var ws []testWrite
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case w := <-c.c:
+			ws = append(ws, w)
+		case <-timer.C:
+			return ws
+		}
+	}
+}
+
+// testHandler 记录回调
+type testHandler struct {
+	sync.Mutex
+	requests  []string
+	responses []string
+	errors    []error
+	onRequest func(*Request)
+}
+
+func (h *testHandler) HandleRequest(r *Request) {
+	h.Lock()
+	h.requests = append(h.requests, r.RequestMethod())
+	h.Unlock()
+	if h.onRequest != nil {
+		h.onRequest(r)
+	}
+}
+
+func (h *testHandler) HandleResponse(r *Response) {
+	h.Lock()
+	h.responses = append(h.responses, r.ResponseStatus())
+	h.Unlock()
+}
+
+func (h *testHandler) HandleError(e *TransactionError) {
+	h.Lock()
+	h.errors = append(h.errors, e.Err)
+	h.Unlock()
+}
+
+// result 返回回调的拷贝
+func (h *testHandler) result() (requests, responses []string, errors []error) {
+	h.Lock()
+	defer h.Unlock()
+	return append([]string(nil), h.requests...), append([]string(nil), h.responses...), append([]error(nil), h.errors...)
+}
+
+// testResponseHandler 没有实现 ErrorHandler ，超时回调本地的 408
+type testResponseHandler struct {
+	h *testHandler
+}
+
+func (h testResponseHandler) HandleRequest(r *Request) {
+	h.h.HandleRequest(r)
+}
+
+func (h testResponseHandler) HandleResponse(r *Response) {
+	h.h.HandleResponse(r)
+}
+
+// testTimer 是测试使用的定时器，64*T1 是 640ms ，Timer C 大于 TryingDelay
+var testTimer = Timer{T1: 10 * time.Millisecond, T2: 40 * time.Millisecond, T4: 50 * time.Millisecond, C: 400 * time.Millisecond}
+
+// newTestServer 返回一个不监听的服务，使用 handleMessage 输入消息
+func newTestServer(h Handler) *Server {
+	s := &Server{AddrPort: "127.0.0.1:5060", Handler: h, Timer: testTimer, WriteTimeout: time.Second}
+	s.Timer.init()
+	s.clienttx.init()
+	s.servertx.init()
+	s.dialogs.init()
+	s.msgPool.New = func() any { return new(Message) }
+	s.quit.Init(0)
+	atomic.StoreInt32(&s.ok, 1)
+	return s
+}
+
+// closeTest 结束所有事务协程
+func (s *Server) closeTest() {
+	s.quit.Close()
+	s.wg.Wait()
+}
+
+// newTestRequest 返回对方发送的请求，Via 是 conn 的地址
+func newTestRequest(method string) *Message {
+	m := new(Message)
+	m.isRequest = true
+	m.InitStartLineOfRequest(method, "sip:bob@127.0.0.1:5060")
+	m.Header.Via = append(m.Header.Via, NewVia("UDP", "127.0.0.1:5070", nil, nil))
+	m.Header.From.Parse("<sip:alice@127.0.0.1:5070>;tag=1928301774")
+	m.Header.To.Parse("<sip:bob@127.0.0.1:5060>")
+	m.Header.CallID = NewBranch()
+	m.Header.CSeq.SN = 1
+	m.Header.CSeq.Method = method
+	m.Header.MaxForwards.Set(70)
+	return m
+}
+
+// newTestClientRequest 返回 s 发送的请求
+func newTestClientRequest(s *Server, method string) *Message {
+	var from, to Address
+	from.Parse("<sip:alice@127.0.0.1:5060>")
+	to.Parse("<sip:bob@127.0.0.1:5070>")
+	return s.NewRequest(method, "sip:bob@127.0.0.1:5070", from, to)
+}
+
+// copyTestMessage 返回 msg 的拷贝，handleMessage 会回收消息
+func copyTestMessage(msg *Message) *Message {
+	m := new(Message)
+	msg.CopyTo(m)
+	return m
+}
+
+// newTestResponse 返回 req 的响应，除了 100 都有 To 的 tag
+func newTestResponse(req *Message, status, tag string) *Message {
+	res := NewResponse(req, status, "")
+	if status != StatusTrying {
+		res.Header.To.Tag = tag
+	}
+	return res
+}
+
+// checkTestIntervals 检查 ws 的间隔，第一个是 T1 ，然后翻倍，最大是 max
+func checkTestIntervals(t *testing.T, ws []testWrite, max time.Duration) {
+	t.Helper()
+	rto := testTimer.T1
+	for i := 1; i < len(ws); i++ {
+		d := ws[i].time.Sub(ws[i-1].time)
+		if d < rto-rto/4 || d > rto+rto/2+5*time.Millisecond {
+			t.Fatalf("interval %d is %v, want %v", i, d, rto)
+		}
+		rto *= 2
+		if rto > max {
+			rto = max
+		}
+	}
+}
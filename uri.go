@@ -2,6 +2,8 @@ package sip
 
 import (
 	"errors"
+	"net"
+	"net/url"
 	"strings"
 )
 
@@ -9,90 +11,391 @@ var (
 	errURIFormat = errors.New("error uri format")
 )
 
-// URI 表示 sip:name@address;transport=tcp
+// 转义时，除了 unreserved 以外允许的字符，RFC 3261 25.1
+const (
+	uriUserUnreserved     = "&=+$,;?/"
+	uriPasswordUnreserved = "&=+$,"
+	uriParamUnreserved    = "[]/:&+$"
+	uriHeaderUnreserved   = "[]/?:+$"
+)
+
+// URI 表示 sip:name:password@address;k=v?k=v ，RFC 3261 19.1 。
+// Name 、Password 和参数、头的值都是转义前的，格式化时自动转义。
+// tel:number;k=v 的 Name 是号码，Address 为空，使用 TelURI 转换。
 type URI struct {
-	Scheme         string
-	Name           string
-	Address        string
-	Transport      string
+	Scheme string
+	// user
+	Name     string
+	Password string
+	// host:port ，ipv6 是 [host]:port
+	Address string
+	// 参数，按照顺序，没有值的参数 Value 为空，比如 lr
+	Params []KV
+	// ? 后面的头，按照顺序
+	Headers        []KV
 	OriginalString string `json:"-"`
 }
 
 // Reset 重置数据
 func (u *URI) Reset() {
 	u.Scheme = ""
-	u.Scheme = ""
+	u.Name = ""
+	u.Password = ""
 	u.Address = ""
+	u.Params = nil
+	u.Headers = nil
 	u.OriginalString = ""
 }
 
+// CopyTo 拷贝到 uu ，不共享 Params 和 Headers
+func (u *URI) CopyTo(uu *URI) {
+	*uu = *u
+	uu.Params = append([]KV(nil), u.Params...)
+	uu.Headers = append([]KV(nil), u.Headers...)
+}
+
 // Parse 从 line 解析数据。
 func (u *URI) Parse(line string) error {
+	u.Reset()
 	u.OriginalString = line
-	line = TrimByte(line, '<', '>')
-	// 分段
-	part := strings.Split(line, ";")
+	line = TrimByte(strings.TrimSpace(line), '<', '>')
 	// scheme:
-	i := strings.IndexByte(part[0], ':')
-	if i < 0 {
+	i := strings.IndexByte(line, ':')
+	if i < 1 {
 		return errURIFormat
 	}
-	u.Scheme = part[0][:i]
-	if u.Scheme == "" {
-		return errURIFormat
+	u.Scheme = strings.ToLower(line[:i])
+	// tel 没有 host
+	if u.Scheme == "tel" {
+		return u.parseTel(u.OriginalString)
 	}
-	part[0] = part[0][i+1:]
-	// name@address
-	i = strings.IndexByte(part[0], '@')
-	if i > 0 {
-		u.Name = part[0][:i]
-		if u.Name == "" {
-			return errURIFormat
+	line = line[i+1:]
+	// ?headers
+	i = strings.IndexByte(line, '?')
+	if i >= 0 {
+		err := parseURIKVs(&u.Headers, line[i+1:], "&")
+		if err != nil {
+			return err
 		}
+		line = line[:i]
 	}
-	u.Address = part[0][i+1:]
-	if u.Address == "" {
-		return errURIFormat
-	}
-	for i := 1; i < len(part); i++ {
-		var kv KV
-		err := kv.Parse(part[i])
+	// name:password@ ，name 里面可以有 ; ，参数里面没有 @
+	i = strings.LastIndexByte(line, '@')
+	if i >= 0 {
+		err := u.parseUserInfo(line[:i])
 		if err != nil {
-			return errURIFormat
+			return err
 		}
-		if kv.Key == "transport" {
-			u.Transport = kv.Value
+		line = line[i+1:]
+	}
+	// ;params
+	i = strings.IndexByte(line, ';')
+	if i >= 0 {
+		err := parseURIKVs(&u.Params, line[i+1:], ";")
+		if err != nil {
+			return err
 		}
+		line = line[:i]
+	}
+	// host:port
+	if !isHostPort(line) {
+		return errURIFormat
 	}
+	u.Address = line
 	return nil
 }
 
-// FormatTo 格式化到 writer 中。
-func (u *URI) FormatTo(writer Writer) error {
-	_, err := writer.WriteString("<")
+// parseTel 解析 tel ，Name 是号码，RFC 3966
+func (u *URI) parseTel(line string) error {
+	var t TelURI
+	err := t.Parse(line)
 	if err != nil {
 		return err
 	}
-	_, err = writer.WriteString(u.Scheme)
-	if err != nil {
-		return err
+	u.Name = t.Number
+	u.Params = t.Params
+	return nil
+}
+
+// parseUserInfo 解析 name:password
+func (u *URI) parseUserInfo(line string) error {
+	name, password, ok := strings.Cut(line, ":")
+	if name == "" {
+		return errURIFormat
 	}
-	_, err = writer.WriteString(":")
+	var err error
+	u.Name, err = url.PathUnescape(name)
 	if err != nil {
-		return err
+		return errURIFormat
 	}
-	_, err = writer.WriteString(u.Name)
+	if ok {
+		u.Password, err = url.PathUnescape(password)
+		if err != nil {
+			return errURIFormat
+		}
+	}
+	return nil
+}
+
+// parseURIKVs 解析使用 sep 分隔的 k=v 到 kvs ，并且反转义
+func parseURIKVs(kvs *[]KV, line, sep string) error {
+	for _, s := range strings.Split(line, sep) {
+		k, v, _ := strings.Cut(s, "=")
+		k, err := url.PathUnescape(strings.TrimSpace(k))
+		if err != nil || k == "" {
+			return errURIFormat
+		}
+		v, err = url.PathUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return errURIFormat
+		}
+		*kvs = append(*kvs, KV{Key: k, Value: v})
+	}
+	return nil
+}
+
+// isHostPort 检查 host[:port] 的格式
+func isHostPort(s string) bool {
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") {
+		// ipv6
+		i := strings.IndexByte(s, ']')
+		if i < 0 {
+			return false
+		}
+		host, port = s[1:i], s[i+1:]
+		if net.ParseIP(host) == nil {
+			return false
+		}
+		if port != "" {
+			if port[0] != ':' {
+				return false
+			}
+			port = port[1:]
+		}
+	} else if i := strings.IndexByte(s, ':'); i >= 0 {
+		host, port = s[:i], s[i+1:]
+	}
+	if host == "" {
+		return false
+	}
+	if port == "" {
+		return !strings.HasSuffix(s, ":")
+	}
+	return isPort(port)
+}
+
+// Host 返回 host ，ipv6 不带 []
+func (u *URI) Host() string {
+	host, _, err := net.SplitHostPort(u.Address)
 	if err != nil {
-		return err
+		return strings.Trim(u.Address, "[]")
 	}
-	_, err = writer.WriteString("@")
+	return host
+}
+
+// Port 返回 port ，没有返回空字符串
+func (u *URI) Port() string {
+	_, port, err := net.SplitHostPort(u.Address)
 	if err != nil {
-		return err
+		return ""
+	}
+	return port
+}
+
+// Param 返回参数 key 的值，key 不区分大小写，第二个返回值表示是否存在
+func (u *URI) Param(key string) (string, bool) {
+	for i := 0; i < len(u.Params); i++ {
+		if strings.EqualFold(u.Params[i].Key, key) {
+			return u.Params[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// SetParam 设置参数，没有就添加到最后
+func (u *URI) SetParam(key, value string) {
+	for i := 0; i < len(u.Params); i++ {
+		if strings.EqualFold(u.Params[i].Key, key) {
+			u.Params[i].Value = value
+			return
+		}
+	}
+	u.Params = append(u.Params, KV{Key: key, Value: value})
+}
+
+// RemoveParam 移除参数
+func (u *URI) RemoveParam(key string) {
+	for i := 0; i < len(u.Params); i++ {
+		if strings.EqualFold(u.Params[i].Key, key) {
+			u.Params = append(u.Params[:i], u.Params[i+1:]...)
+			return
+		}
 	}
-	_, err = writer.WriteString(u.Address)
+}
+
+// IsSecure 返回是否 sips ，需要使用 tls
+func (u *URI) IsSecure() bool {
+	return u.Scheme == "sips"
+}
+
+// Transport 返回 transport 参数的值，小写
+func (u *URI) Transport() string {
+	v, _ := u.Param("transport")
+	return strings.ToLower(v)
+}
+
+// FormatTo 格式化到 writer 中，不包含 <>
+func (u *URI) FormatTo(writer Writer) error {
+	_, err := writer.WriteString(u.requestURI())
 	if err != nil {
 		return err
 	}
-	_, err = writer.WriteString(">")
-	return err
+	// headers
+	for i := 0; i < len(u.Headers); i++ {
+		if i == 0 {
+			err = writer.WriteByte('?')
+		} else {
+			err = writer.WriteByte('&')
+		}
+		if err != nil {
+			return err
+		}
+		_, err = writer.WriteString(escapeURI(u.Headers[i].Key, uriHeaderUnreserved))
+		if err != nil {
+			return err
+		}
+		err = writer.WriteByte('=')
+		if err != nil {
+			return err
+		}
+		_, err = writer.WriteString(escapeURI(u.Headers[i].Value, uriHeaderUnreserved))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String 返回格式化后的字符串，不包含 <>
+func (u *URI) String() string {
+	var str strings.Builder
+	u.FormatTo(&str)
+	return str.String()
+}
+
+// requestURI 返回用于 Request-URI 的格式，不包含 ? 后面的头，RFC 3261 19.1.5
+func (u *URI) requestURI() string {
+	var str strings.Builder
+	str.WriteString(u.Scheme)
+	str.WriteByte(':')
+	if u.Name != "" {
+		str.WriteString(escapeURI(u.Name, uriUserUnreserved))
+		if u.Password != "" {
+			str.WriteByte(':')
+			str.WriteString(escapeURI(u.Password, uriPasswordUnreserved))
+		}
+		if u.Address != "" {
+			str.WriteByte('@')
+		}
+	}
+	str.WriteString(u.Address)
+	for i := 0; i < len(u.Params); i++ {
+		str.WriteByte(';')
+		str.WriteString(escapeURI(u.Params[i].Key, uriParamUnreserved))
+		if u.Params[i].Value != "" {
+			str.WriteByte('=')
+			str.WriteString(escapeURI(u.Params[i].Value, uriParamUnreserved))
+		}
+	}
+	return str.String()
+}
+
+// Equal 按照 RFC 3261 19.1.4 比较 u 和 uu 是否相等。
+// user 和 password 区分大小写，host 和参数不区分，没有端口和有默认端口是不相等的。
+// user ttl method maddr transport 参数必须都有或者都没有，其他的参数只比较两个都有的，
+// 头必须全部相同
+func (u *URI) Equal(uu *URI) bool {
+	if !strings.EqualFold(u.Scheme, uu.Scheme) ||
+		u.Name != uu.Name ||
+		u.Password != uu.Password ||
+		!strings.EqualFold(u.Host(), uu.Host()) ||
+		u.Port() != uu.Port() {
+		return false
+	}
+	// 参数
+	if !uriParamsEqual(u, uu) || !uriParamsEqual(uu, u) {
+		return false
+	}
+	// 头
+	if len(u.Headers) != len(uu.Headers) {
+		return false
+	}
+	for i := 0; i < len(u.Headers); i++ {
+		found := false
+		for j := 0; j < len(uu.Headers); j++ {
+			if strings.EqualFold(u.Headers[i].Key, uu.Headers[j].Key) &&
+				u.Headers[i].Value == uu.Headers[j].Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// uriParamsEqual 检查 u 的参数在 uu 中是否匹配
+func uriParamsEqual(u, uu *URI) bool {
+	for i := 0; i < len(u.Params); i++ {
+		v, ok := uu.Param(u.Params[i].Key)
+		if !ok {
+			switch strings.ToLower(u.Params[i].Key) {
+			case "user", "ttl", "method", "maddr", "transport":
+				return false
+			}
+			continue
+		}
+		if !strings.EqualFold(u.Params[i].Value, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeURI 转义 s 中除了 unreserved 和 extra 以外的字符
+func escapeURI(s, extra string) string {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if !isURIUnreserved(s[i], extra) {
+			n++
+		}
+	}
+	if n == 0 {
+		return s
+	}
+	const hex = "0123456789ABCDEF"
+	var str strings.Builder
+	str.Grow(len(s) + 2*n)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isURIUnreserved(c, extra) {
+			str.WriteByte(c)
+			continue
+		}
+		str.WriteByte('%')
+		str.WriteByte(hex[c>>4])
+		str.WriteByte(hex[c&15])
+	}
+	return str.String()
+}
+
+// isURIUnreserved 返回 c 是否是 unreserved 或者 extra 中的字符
+func isURIUnreserved(c byte, extra string) bool {
+	if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+		return true
+	}
+	return strings.IndexByte("-_.!~*'()", c) >= 0 || strings.IndexByte(extra, c) >= 0
 }
@@ -13,6 +13,69 @@ func Test_URI(t *testing.T) {
 		uri.Address != "456" {
 		t.FailNow()
 	}
+	// 全部
+	err = uri.Parse(`<sips:al%20ice:secret@[2001:db8::10]:5061;transport=TCP;lr;maddr=239.255.255.1?subject=project%20x&priority=urgent>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "sips" || uri.Name != "al ice" || uri.Password != "secret" ||
+		uri.Address != "[2001:db8::10]:5061" || uri.Host() != "2001:db8::10" || uri.Port() != "5061" {
+		t.FailNow()
+	}
+	if len(uri.Params) != 3 || uri.Params[1].Key != "lr" || uri.Params[1].Value != "" || uri.Transport() != "tcp" {
+		t.FailNow()
+	}
+	if len(uri.Headers) != 2 || uri.Headers[0].Value != "project x" {
+		t.FailNow()
+	}
+	if uri.String() != `sips:al%20ice:secret@[2001:db8::10]:5061;transport=TCP;lr;maddr=239.255.255.1?subject=project%20x&priority=urgent` {
+		t.Fatal(uri.String())
+	}
+	// user 里面有 ;
+	err = uri.Parse(`sip:alice;day=tuesday@atlanta.com`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Name != "alice;day=tuesday" || uri.Address != "atlanta.com" || len(uri.Params) != 0 {
+		t.FailNow()
+	}
+	// 没有 user
+	err = uri.Parse(`sip:3402000000`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Name != "" || uri.Address != "3402000000" || uri.String() != "sip:3402000000" {
+		t.FailNow()
+	}
+}
+
+func Test_URI_Equal(t *testing.T) {
+	for _, c := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{`sip:%61lice@atlanta.com;transport=TCP`, `sip:alice@AtLanTa.CoM;Transport=tcp`, true},
+		{`sip:carol@chicago.com`, `sip:carol@chicago.com;newparam=5`, true},
+		{`sip:carol@chicago.com;security=on`, `sip:carol@chicago.com;newparam=5`, true},
+		{`sip:biloxi.com;transport=tcp;method=REGISTER?to=sip:bob%40biloxi.com`, `sip:biloxi.com;method=REGISTER;transport=tcp?to=sip:bob%40biloxi.com`, true},
+		{`sip:alice@atlanta.com?subject=project%20x&priority=urgent`, `sip:alice@atlanta.com?priority=urgent&subject=project%20x`, true},
+		{`SIP:ALICE@AtLanTa.CoM;Transport=udp`, `sip:alice@AtLanTa.CoM;Transport=UDP`, false},
+		{`sip:bob@biloxi.com`, `sip:bob@biloxi.com:5060`, false},
+		{`sip:bob@biloxi.com`, `sip:bob@biloxi.com;transport=udp`, false},
+		{`sip:carol@chicago.com`, `sip:carol@chicago.com?Subject=next%20meeting`, false},
+		{`sip:carol@chicago.com;security=on`, `sip:carol@chicago.com;security=off`, false},
+	} {
+		var a, b URI
+		if err := a.Parse(c.a); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Parse(c.b); err != nil {
+			t.Fatal(err)
+		}
+		if a.Equal(&b) != c.equal || b.Equal(&a) != c.equal {
+			t.Fatal(c.a, c.b)
+		}
+	}
 }
 
 func Test_URI_Error(t *testing.T) {
@@ -21,10 +84,13 @@ func Test_URI_Error(t *testing.T) {
 		":123@456",
 		"sip:@456",
 		"123@456",
-		"sip:123",
+		"sip:123@",
+		"sip:123@456:abc",
+		"sip:123@[::1",
+		"sip:123@456;=1",
 	} {
 		if err := uri.Parse(s); err == nil {
-			t.FailNow()
+			t.Fatal(s)
 		}
 	}
 }
@@ -2,6 +2,8 @@ package sip
 
 import (
 	"errors"
+	"net"
+	"strconv"
 	"strings"
 )
 
@@ -21,80 +23,184 @@ func NewVia(proto, addr string, rport, received *string) Via {
 	}
 }
 
-// Via 表示 version address;rport=x;branch=x
+// Via 表示 version/proto sent-by;rport=x;branch=x;k=v ，RFC 3261 20.42 。
+// sent-by 是 host:port ，ipv6 是 [host]:port
 type Via struct {
-	Version        string
-	Proto          string
-	Address        string
-	Branch         string
-	RProt          *string
-	Received       *string
+	Version  string
+	Proto    string
+	Address  string
+	Branch   string
+	RProt    *string
+	Received *string
+	MAddr    string
+	// 参数，按照顺序，包括上面的几个，比如 ttl alias keep ，格式化时上面的字段优先
+	Params         []KV
 	OriginalString string `json:"-"`
 }
 
 // Reset 重置数据
 func (v *Via) Reset() {
 	v.Version = ""
+	v.Proto = ""
 	v.Address = ""
 	v.RProt = nil
 	v.Received = nil
 	v.Branch = ""
+	v.MAddr = ""
+	v.Params = nil
 	v.OriginalString = ""
 }
 
+// CopyTo 拷贝到 vv ，不共享 Params 、RProt 和 Received
+func (v *Via) CopyTo(vv *Via) {
+	*vv = *v
+	vv.Params = append([]KV(nil), v.Params...)
+	if v.RProt != nil {
+		rport := *v.RProt
+		vv.RProt = &rport
+	}
+	if v.Received != nil {
+		received := *v.Received
+		vv.Received = &received
+	}
+}
+
 // Parse 从 line 解析数据。
 func (v *Via) Parse(line string) error {
+	v.Reset()
 	v.OriginalString = line
-	// 分段
-	parts := strings.Split(line, ";")
-	// version/proto address
+	// 分段，参数的值可以是 quoted-string
+	parts := splitQuoted(line, ';')
+	if len(parts) < 1 {
+		return errHeaderViaFormat
+	}
+	// version/proto sent-by ，/ 两边可以有空格
 	fields := strings.Fields(parts[0])
-	if len(fields) != 2 {
+	if len(fields) < 2 {
 		return errHeaderViaFormat
 	}
 	// version/proto
-	i := strings.LastIndexByte(fields[0], '/')
+	protocol := strings.Join(fields[:len(fields)-1], "")
+	i := strings.LastIndexByte(protocol, '/')
 	if i < 0 {
+		v.Version = protocol
+	} else {
+		v.Version = protocol[:i]
+		v.Proto = protocol[i+1:]
+	}
+	// sent-by
+	v.Address = fields[len(fields)-1]
+	if !isHostPort(v.Address) {
 		return errHeaderViaFormat
 	}
-	v.Version = fields[0][:i]
-	v.Proto = fields[0][i+1:]
-	// address
-	v.Address = fields[1]
-	// rport=x;branch=x
-	var kv KV
+	// rport=x;branch=x;k=v
 	for _, part := range parts[1:] {
+		var kv KV
 		err := kv.Parse(part)
 		if err != nil {
 			return errHeaderViaFormat
 		}
-		switch kv.Key {
+		switch strings.ToLower(kv.Key) {
 		case "rport":
-			v.RProt = &kv.Value
+			if kv.Value != "" && !isPort(kv.Value) {
+				return errHeaderViaFormat
+			}
+			rport := kv.Value
+			v.RProt = &rport
 		case "branch":
 			v.Branch = kv.Value
 		case "received":
-			v.Received = &kv.Value
+			received := kv.Value
+			v.Received = &received
+		case "maddr":
+			v.MAddr = kv.Value
+		case "ttl":
+			_, err := strconv.ParseUint(kv.Value, 10, 8)
+			if err != nil {
+				return errHeaderViaFormat
+			}
 		}
+		v.Params = append(v.Params, kv)
 	}
 	return nil
 }
 
+// isPort 检查端口的格式
+func isPort(s string) bool {
+	n, err := strconv.ParseUint(s, 10, 16)
+	return err == nil && n > 0
+}
+
+// Param 返回参数 key 的值，key 不区分大小写，第二个返回值表示是否存在
+func (v *Via) Param(key string) (string, bool) {
+	for i := 0; i < len(v.Params); i++ {
+		if strings.EqualFold(v.Params[i].Key, key) {
+			return v.Params[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// SetParam 设置参数，没有就添加到最后，
+// rport branch received maddr 请使用对应的字段
+func (v *Via) SetParam(key, value string) {
+	for i := 0; i < len(v.Params); i++ {
+		if strings.EqualFold(v.Params[i].Key, key) {
+			v.Params[i].Value = value
+			return
+		}
+	}
+	v.Params = append(v.Params, KV{Key: key, Value: value})
+}
+
+// RemoveParam 移除参数
+func (v *Via) RemoveParam(key string) {
+	for i := 0; i < len(v.Params); i++ {
+		if strings.EqualFold(v.Params[i].Key, key) {
+			v.Params = append(v.Params[:i:i], v.Params[i+1:]...)
+			return
+		}
+	}
+}
+
+// param 返回字段对应的参数，第二个返回值表示 key 是否字段，第三个表示是否需要格式化
+func (v *Via) param(key string) (string, bool, bool) {
+	switch strings.ToLower(key) {
+	case "rport":
+		if v.RProt == nil {
+			return "", true, false
+		}
+		return *v.RProt, true, true
+	case "branch":
+		return v.Branch, true, v.Branch != ""
+	case "maddr":
+		return v.MAddr, true, v.MAddr != ""
+	case "received":
+		if v.Received == nil {
+			return "", true, false
+		}
+		return *v.Received, true, true
+	}
+	return "", false, false
+}
+
 // FormatTo 格式化到 writer 中。
 func (v *Via) FormatTo(writer Writer) error {
 	var err error
-	// version address
+	// version/proto sent-by
 	_, err = writer.WriteString(v.Version)
 	if err != nil {
 		return err
 	}
-	_, err = writer.WriteString("/")
-	if err != nil {
-		return err
-	}
-	_, err = writer.WriteString(v.Proto)
-	if err != nil {
-		return err
+	if v.Proto != "" {
+		_, err = writer.WriteString("/")
+		if err != nil {
+			return err
+		}
+		_, err = writer.WriteString(v.Proto)
+		if err != nil {
+			return err
+		}
 	}
 	_, err = writer.WriteString(" ")
 	if err != nil {
@@ -104,50 +210,160 @@ func (v *Via) FormatTo(writer Writer) error {
 	if err != nil {
 		return err
 	}
-	// rport
-	if v.RProt != nil {
-		_, err = writer.WriteString(";rport")
-		if err != nil {
-			return err
-		}
-		if *v.RProt != "" {
-			err = writer.WriteByte('=')
-			if err != nil {
-				return err
-			}
-			_, err = writer.WriteString(*v.RProt)
-			if err != nil {
-				return err
+	// 参数，按照顺序，字段使用字段的值
+	var written [4]bool
+	for i := 0; i < len(v.Params); i++ {
+		kv := v.Params[i]
+		value, field, ok := v.param(kv.Key)
+		if field {
+			j := viaFieldIndex(kv.Key)
+			if !ok || written[j] {
+				continue
 			}
+			written[j] = true
+			kv.Value = value
 		}
-	}
-	// branch
-	if v.Branch != "" {
-		_, err = writer.WriteString(";branch=")
+		err = formatViaParam(writer, kv.Key, kv.Value)
 		if err != nil {
 			return err
 		}
-		_, err = writer.WriteString(v.Branch)
+	}
+	// 没有在参数里的字段
+	for j, key := range viaFields {
+		if written[j] {
+			continue
+		}
+		value, _, ok := v.param(key)
+		if !ok {
+			continue
+		}
+		err = formatViaParam(writer, key, value)
 		if err != nil {
 			return err
 		}
 	}
-	// received
-	if v.Received != nil {
-		_, err = writer.WriteString(";received")
-		if err != nil {
-			return err
+	return nil
+}
+
+// 字段对应的参数，没有在 Params 里的按照这个顺序格式化
+var viaFields = [4]string{"rport", "branch", "maddr", "received"}
+
+// viaFieldIndex 返回 key 在 viaFields 的下标
+func viaFieldIndex(key string) int {
+	for i, k := range viaFields {
+		if strings.EqualFold(k, key) {
+			return i
 		}
-		if *v.Received != "" {
-			err = writer.WriteByte('=')
-			if err != nil {
-				return err
-			}
-			_, err = writer.WriteString(*v.Received)
-			if err != nil {
-				return err
-			}
+	}
+	return -1
+}
+
+// formatViaParam 格式化 ;k=v ，v 为空只有 ;k
+func formatViaParam(writer Writer, key, value string) error {
+	err := writer.WriteByte(';')
+	if err != nil {
+		return err
+	}
+	_, err = writer.WriteString(key)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		return nil
+	}
+	err = writer.WriteByte('=')
+	if err != nil {
+		return err
+	}
+	_, err = writer.WriteString(value)
+	return err
+}
+
+// Host 返回 sent-by 的 host ，ipv6 不带 []
+func (v *Via) Host() string {
+	host, _, err := net.SplitHostPort(v.Address)
+	if err != nil {
+		return strings.Trim(v.Address, "[]")
+	}
+	return host
+}
+
+// Port 返回 sent-by 的 port ，没有返回空字符串
+func (v *Via) Port() string {
+	_, port, err := net.SplitHostPort(v.Address)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// setViaReceived 处理收到的请求的第一个 Via ，RFC 3261 18.2.1 ，RFC 3581 4 。
+// sent-by 的 host 和来源 ip 不同，添加 received ，
+// 有 rport 的，添加 received 并设置 rport 为来源端口
+func setViaReceived(conn Conn, msg *Message) {
+	if len(msg.Header.Via) < 1 {
+		return
+	}
+	via := &msg.Header.Via[0]
+	ip := conn.RemoteIP()
+	if via.RProt != nil {
+		port := conn.RemotePort()
+		via.RProt = &port
+		via.Received = &ip
+		return
+	}
+	if via.Host() != ip {
+		via.Received = &ip
+	}
+}
+
+// learnPublicAddr 开启了 LearnPublicAddr 时，从 conn 收到的响应的第一个 Via 的 received 和 rport
+// 学习 conn 的对方看到的自己的公网地址，RFC 3581 9
+func (s *Server) learnPublicAddr(conn Conn, msg *Message) {
+	if !s.LearnPublicAddr || len(msg.Header.Via) < 1 {
+		return
+	}
+	via := &msg.Header.Via[0]
+	if via.Received == nil && (via.RProt == nil || *via.RProt == "") {
+		return
+	}
+	host := via.Host()
+	if via.Received != nil && *via.Received != "" {
+		host = *via.Received
+	}
+	port := via.Port()
+	if via.RProt != nil && *via.RProt != "" {
+		port = *via.RProt
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	s.publicAddr.Store(conn.RemoteAddrString(), host)
+}
+
+// PublicAddr 返回对方地址 addr（ip:port）看到的自己的公网地址，
+// 没有开启 LearnPublicAddr 或者还没有学习到返回 AddrPort
+func (s *Server) PublicAddr(addr string) string {
+	if a, ok := s.publicAddr.Load(addr); ok {
+		return a.(string)
+	}
+	return s.AddrPort
+}
+
+// setPublicAddr 把请求 msg 的第一个 Via 的 sent-by 和 Contact 中的 AddrPort ，
+// 替换为 conn 的对方看到的自己的公网地址
+func (s *Server) setPublicAddr(conn Conn, msg *Message) {
+	addr := s.PublicAddr(conn.RemoteAddrString())
+	if addr == s.AddrPort {
+		return
+	}
+	if via := &msg.Header.Via[0]; via.Address == s.AddrPort {
+		via.Address = addr
+	}
+	for i := 0; i < len(msg.Header.Contact); i++ {
+		c := &msg.Header.Contact[i]
+		if !c.Star && c.URI.Address == s.AddrPort {
+			c.URI.Address = addr
 		}
 	}
-	return nil
 }
@@ -1,6 +1,9 @@
 package sip
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func Test_Via(t *testing.T) {
 	var via Via
@@ -38,15 +41,153 @@ func Test_Via(t *testing.T) {
 	}
 }
 
+func Test_Via_Params(t *testing.T) {
+	var via Via
+	err := via.Parse(`SIP / 2.0 / UDP [2001:db8::9]:5060;branch=z9hG4bK87asdks7;ttl=16;maddr=224.2.0.1;alias;keep;x-vendor="a;b";rport`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if via.Version != "SIP/2.0" || via.Proto != "UDP" || via.Host() != "2001:db8::9" || via.Port() != "5060" {
+		t.FailNow()
+	}
+	if via.MAddr != "224.2.0.1" || via.Branch != "z9hG4bK87asdks7" || via.RProt == nil || len(via.Params) != 7 {
+		t.FailNow()
+	}
+	if v, ok := via.Param("ttl"); !ok || v != "16" {
+		t.FailNow()
+	}
+	if _, ok := via.Param("keep"); !ok {
+		t.FailNow()
+	}
+	// 格式化，参数的顺序不变，字段的值优先，没有的添加到最后
+	rport, received := "5070", "1.2.3.4"
+	via.RProt = &rport
+	via.Received = &received
+	via.SetParam("keep", "30")
+	var b strings.Builder
+	via.FormatTo(&b)
+	if b.String() != `SIP/2.0/UDP [2001:db8::9]:5060;branch=z9hG4bK87asdks7;ttl=16;maddr=224.2.0.1;alias;keep=30;x-vendor="a;b";rport=5070;received=1.2.3.4` {
+		t.Fatal(b.String())
+	}
+	// 拷贝不共享参数
+	var via2 Via
+	via.CopyTo(&via2)
+	via2.RemoveParam("alias")
+	if _, ok := via.Param("alias"); !ok || len(via2.Params) != 6 {
+		t.FailNow()
+	}
+}
+
 func Test_Via_Error(t *testing.T) {
 	var via Via
 	for _, s := range []string{
 		`v1`,
 		`v1;rport;branch=3`,
 		`v1 a2;rport=abc;branch=3`,
+		`SIP/2.0/UDP [::1:5060;branch=3`,
+		`SIP/2.0/UDP a2;ttl=256`,
+		`SIP/2.0/UDP a2;=1;branch=3`,
 	} {
 		if err := via.Parse(s); err == nil {
 			t.FailNow()
 		}
 	}
 }
+
+func Test_Via_Received(t *testing.T) {
+	conn := &udpConn{remoteIP: "1.2.3.4", remotePort: "5070", remoteAddr: "1.2.3.4:5070"}
+	var msg Message
+	msg.Header.Via = make([]Via, 1)
+	// 有 rport
+	err := msg.Header.Via[0].Parse(`SIP/2.0/UDP 192.168.1.2:5060;rport;branch=z9hG4bK776asdhds`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setViaReceived(conn, &msg)
+	via := &msg.Header.Via[0]
+	if via.Received == nil || *via.Received != "1.2.3.4" || via.RProt == nil || *via.RProt != "5070" ||
+		via.Branch != "z9hG4bK776asdhds" {
+		t.FailNow()
+	}
+	// 没有开启不学习
+	var s Server
+	s.AddrPort = "192.168.1.2:5060"
+	s.learnPublicAddr(conn, &msg)
+	if s.PublicAddr(conn.RemoteAddrString()) != s.AddrPort {
+		t.FailNow()
+	}
+	// 学习
+	s.LearnPublicAddr = true
+	s.learnPublicAddr(conn, &msg)
+	if s.PublicAddr(conn.RemoteAddrString()) != "1.2.3.4:5070" {
+		t.FailNow()
+	}
+	// 没有 rport ，host 相同
+	via.Reset()
+	err = via.Parse(`SIP/2.0/UDP 1.2.3.4:5060;branch=z9hG4bK776asdhds`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setViaReceived(conn, &msg)
+	if via.Received != nil || via.RProt != nil {
+		t.FailNow()
+	}
+	// 没有 rport ，host 不同
+	via.Reset()
+	err = via.Parse(`SIP/2.0/UDP pc1.atlanta.com;branch=z9hG4bK776asdhds`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setViaReceived(conn, &msg)
+	if via.Received == nil || *via.Received != "1.2.3.4" || via.RProt != nil {
+		t.FailNow()
+	}
+}
+
+func Test_Server_LearnPublicAddr(t *testing.T) {
+	s := &Server{AddrPort: "192.168.1.2:5060", LearnPublicAddr: true}
+	// 两个对方看到的地址不一样
+	conn1 := &udpConn{remoteIP: "10.0.0.1", remotePort: "5060", remoteAddr: "10.0.0.1:5060"}
+	conn2 := &udpConn{remoteIP: "20.0.0.1", remotePort: "5060", remoteAddr: "20.0.0.1:5060"}
+	for _, c := range []struct {
+		conn     Conn
+		received string
+		rport    string
+	}{
+		{conn1, "1.2.3.4", "5070"},
+		{conn2, "5.6.7.8", "6080"},
+	} {
+		var msg Message
+		msg.Header.Via = []Via{NewVia("UDP", s.AddrPort, &c.rport, &c.received)}
+		s.learnPublicAddr(c.conn, &msg)
+	}
+	if s.PublicAddr(conn1.RemoteAddrString()) != "1.2.3.4:5070" ||
+		s.PublicAddr(conn2.RemoteAddrString()) != "5.6.7.8:6080" ||
+		s.PublicAddr("30.0.0.1:5060") != s.AddrPort {
+		t.FailNow()
+	}
+	// 发送时替换 Via 和 Contact
+	var from, to Address
+	from.Parse("<sip:alice@atlanta.com>")
+	to.Parse("<sip:bob@biloxi.com>")
+	for _, c := range []struct {
+		conn Conn
+		addr string
+	}{
+		{conn1, "1.2.3.4:5070"},
+		{conn2, "5.6.7.8:6080"},
+		{&udpConn{remoteAddr: "30.0.0.1:5060"}, s.AddrPort},
+	} {
+		m := s.NewRequest(MethodRegister, "sip:biloxi.com", from, to, WithContact(URI{Scheme: "sip", Name: "alice"}))
+		s.setPublicAddr(c.conn, m)
+		if m.Header.Via[0].Address != c.addr || m.Header.Contact[0].URI.Address != c.addr {
+			t.Fatal(c.addr, m.Header.Via[0].Address, m.Header.Contact[0].URI.Address)
+		}
+	}
+	// 本地地址
+	var u URI
+	u.Parse("sip:bob@5.6.7.8:6080")
+	if !s.isLocalURI(&u) {
+		t.FailNow()
+	}
+}